@@ -14,21 +14,21 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
-	"runtime"
 	"runtime/debug"
-	"strconv"
+	"sort"
 	"strings"
 	"syscall"
-	"time"
 
-	"golang.org/x/mod/modfile"
+	"github.com/bruce34/gorun/script"
 )
 
 // BuildInfoString returns the build information stored within the compiled binary, git sha etc.
@@ -49,44 +49,12 @@ too will be copied and included in the build of the go program.
 `, flag.CommandLine.Name())
 	fmt.Fprintf(flag.CommandLine.Output(), "%s [options] <sourceFile.go>:\n", flag.CommandLine.Name())
 	flag.PrintDefaults()
-}
-
-const (
-	GOMOD     = "go.mod"
-	GOSUM     = "go.sum"
-	GOWORK    = "go.work"
-	GOWORKSUM = "go.work.sum"
-)
-
-type Script struct {
-	debug               bool     // more output, don't delete temporary files (GORUN_ARGS=-debug if running script)
-	recompileWrongGoVer bool     // recompile the binary if the go version doesn't match the installed version
-	noRun               bool     // recompile of the binary if required, but don't run. Handy for testing before deployment
-	content             []byte   // contents of the primary script.go file
-	scriptPath          string   // full path to the primary script.go file
-	scriptExtraDir      string   // full path to any extra script dir
-	scriptRelWorkDirs   []string // path to any local referenced (../* only) go.work directories
-	scriptWorkDirs      []string // path to any local referenced (../* only) go.work directories, full path
-	args                []string
-	tmpDirBase          string // where to write subdirectories to
-	perUserTmpDir       string // subdirectory containing all this user's commands (a sub of tmpDirBase)
-	tmpDir              string // subdirectory containing this user's version of the command (a sub of perUserTmpDir)
-	perRunTmpDirBase    string // per PID version of this user's version of the command (deleted after build)
-	perRunTmpDir        string // copy everything down to a completely unique tmp directory and delete it afterwards
-	binary              string // moving the binary to <tmpDir>/script.go.bin just before compiled binary final resting place, lives under tmpDir
-	binaryLastRun       string // file showing the binary was run lately (for filesystems not running atime)
-	cleanSecs           int64  // any binaries not accessed within this number of seconds get deleted (and rebuilt)
-	cleanSecsBuildDirs  int64  // any build directories for this binary older than this get deleted
-}
-
-// realPath returns the real absolute path, resolving symlinks
-func realPath(sourceFile string) (realPath string, err error) {
-	sourceFile, err = filepath.Abs(sourceFile)
-	if err != nil {
-		return
-	}
-	realPath, err = filepath.EvalSymlinks(sourceFile)
-	return
+	fmt.Fprintf(flag.CommandLine.Output(), "%s init <sourceFile.go> [-module name] [-shebang|-binfmt] [-extraDir]:\n", flag.CommandLine.Name())
+	newInitFlags(&script.InitOptions{}, new(bool), new(bool)).PrintDefaults()
+	fmt.Fprintf(flag.CommandLine.Output(), "%s systemd-unit <sourceFile.go> [-user name] [-description text] [-gorun path] [-gorunArgs options] [-- script args]:\n", flag.CommandLine.Name())
+	newUnitFlags(&script.UnitOptions{}, new(string)).PrintDefaults()
+	fmt.Fprintf(flag.CommandLine.Output(), "%s pack <sourceFile.go> [-o archive]:\n", flag.CommandLine.Name())
+	newPackFlags(new(string)).PrintDefaults()
 }
 
 func main() {
@@ -97,27 +65,60 @@ func main() {
 	gorunArgs := strings.Fields(gorunArgsEnv)
 	args := append(gorunArgs, os.Args[1:]...)
 
-	var diff, embed, extract, extractIfMissing, version bool
+	var check, debugLog, diff, embed, explain, extract, extractIfMissing, noRun, patch, tidy, upgrade, version, watch bool
+	var getModules []string
 	var cleanDays int64
+	var logLevel, logFormat, logFile string
 
-	s := Script{}
+	opts := script.Options{BuildOutput: os.Stderr}
 
 	flag.Int64Var(&cleanDays, "cleanDays", 14, "clean all binaries from this user older than N days. Set to -1 to disable cleaning")
+	flag.BoolVar(&check, "check", false, "validate the embedded sections of the script (markers, go.mod, go.sum etc.) reporting problems with line numbers")
 	flag.BoolVar(&diff, "diff", false, "show diff between embedded comments and filesystem go.mod/go.sum/go.work/go.work.sum")
 	flag.BoolVar(&embed, "embed", false, "embed filesystem go.mod/go.sum/go.work/go.work.sum as comments in source file")
+	flag.BoolVar(&explain, "explain", false, "report every reason the script would be recompiled, without building or running it")
 	flag.BoolVar(&extract, "extract", false, "extract the comments to filesystem go.mod/go.sum/go.work/go.work.sum")
 	flag.BoolVar(&extractIfMissing, "extractIfMissing", false, "extract the comments to filesystem go.mod/go.sum/go.work/go.work.sum only if BOTH files do not exist on disc")
-	flag.BoolVar(&s.debug, "debug", false, "provide more debug, don't delete temporary files under /tmp")
-	flag.BoolVar(&s.recompileWrongGoVer, "recompileWrongGoVer", false, "recompile the script if the compiled target wasn't compiled with the currently installed go version")
-	flag.StringVar(&s.tmpDirBase, "targetDirBase", "/var/tmp", "directory to copy script and extract go.mod etc. to before building")
+	flag.Func("get", "run 'go get module@version' on the script in a temporary directory and embed the resulting go.mod/go.sum in to the source file. May be repeated", func(module string) error {
+		getModules = append(getModules, module)
+		return nil
+	})
+	flag.BoolVar(&debugLog, "debug", false, "provide more debug (implies -log-level=debug)")
+	flag.BoolVar(&opts.FallbackLastGood, "fallbackLastGood", false, "if the script fails to compile, run the last binary that compiled (with a warning) rather than failing")
+	flag.BoolVar(&opts.Hermetic, "hermetic", false, "build with only PATH, HOME, proxy and module proxy settings (GOPROXY, GOPRIVATE etc.) and go's file locations from the environment, plus the embedded go.env, so stray GOFLAGS etc. can't change the binary. go env -w settings are ignored")
+	flag.StringVar(&opts.RemoteCache, "remoteCache", "", "share compiled binaries between hosts through this directory (e.g. on a shared filesystem) or http(s) URL (GET/PUT), fetching rather than compiling when the inputs match")
+	flag.BoolVar(&opts.RetryFailed, "retryFailed", false, "compile the script even if the last compile of the same source failed, rather than just reporting that failure again")
+	flag.BoolVar(&opts.RecompileWrongGoVer, "recompileWrongGoVer", false, "recompile the script if the compiled target wasn't compiled with the currently installed go version")
+	flag.StringVar(&opts.TmpDirBase, "targetDirBase", script.DefaultTmpDirBase, "directory to copy script and extract go.mod etc. to before building")
+	flag.BoolVar(&tidy, "tidy", false, "run 'go mod tidy' on the script in a temporary directory and embed the resulting go.mod/go.sum in to the source file")
+	flag.BoolVar(&upgrade, "upgrade", false, "run 'go get -u' on all the script's dependencies in a temporary directory and embed the resulting go.mod/go.sum in to the source file")
+	flag.BoolVar(&patch, "patch", false, "with -upgrade, only upgrade to newer patch releases")
 	flag.BoolVar(&version, "version", false, "Print version info and exit")
-	flag.BoolVar(&s.noRun, "noRun", false, "recompile of the binary if required, but don't run. Handy for testing before deployment")
+	flag.StringVar(&opts.ToolchainDir, "toolchainDir", "", "directory of go toolchains named by version (e.g. /usr/local for /usr/local/go1.24.2/bin/go). If set, build with the toolchain pinned by the embedded go.mod toolchain/go lines")
+	flag.StringVar(&opts.ToolchainPolicy, "toolchainPolicy", script.ToolchainFallback, "if the pinned toolchain isn't in -toolchainDir: 'fallback' to the installed go with a warning, or 'require' and fail")
+	flag.StringVar(&opts.Symlinks, "symlinks", script.SymlinksRecreate, "symlinks in the extra source directory and go.work libraries are 'recreate'd as symlinks in the build, or 'follow'ed and copied as what they point to")
+	flag.BoolVar(&noRun, "noRun", false, "recompile of the binary if required, but don't run. Handy for testing before deployment")
+	flag.BoolVar(&watch, "watch", false, "run the script, recompiling and restarting it whenever it, its extra source directory or go.work libraries change. Arguments for the script can follow '--'")
+	flag.StringVar(&logLevel, "log-level", "warn", "minimum level of gorun's own log messages: debug, info, warn or error")
+	flag.StringVar(&logFormat, "log-format", "text", "format of gorun's own log messages: text or json")
+	flag.StringVar(&logFile, "log-file", "", "write gorun's own log messages to this file instead of stderr, or 'syslog' to send them to syslog/journald")
 	flag.CommandLine.Parse(args)
 
-	if s.debug {
+	if debugLog {
+		logLevel = "debug"
+	} else if watch && !flagSet("log-level") {
+		logLevel = "info" // show each restart
+	}
+	logger, logToStderr, err := newLogger(logLevel, logFormat, logFile)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "error: "+err.Error())
+		os.Exit(1)
+	}
+	opts.Logger = logger
+
+	if debugLog {
 		wd, _ := os.Getwd()
-		_, _ = fmt.Fprintln(os.Stderr, "cwd: "+wd)
-		_, _ = fmt.Fprintln(os.Stderr, "envs: "+strings.Join(os.Environ(), ","))
+		logger.Debug("starting", "cwd", wd, "env", strings.Join(os.Environ(), ","))
 	}
 
 	if version {
@@ -130,891 +131,370 @@ func main() {
 		os.Exit(1)
 	}
 
-	s.args = flag.Args()
-	s.cleanSecs = cleanDays * 24 * 3600
-	s.cleanSecsBuildDirs = 1 * 3600 // 1 hour for cleaning up stale build directories
-
-	sourceFile, err := realPath(flag.Arg(0))
-	if err != nil {
-		fmt.Printf("Failed to find source file %v\n", err.Error())
-		return
+	opts.CleanSecs = cleanDays * 24 * 3600
+	if cleanDays < 0 {
+		opts.CleanSecs = -1
+	} else if cleanDays == 0 {
+		opts.CleanSecs = 1 // zero means the default to the script package
 	}
-	s.scriptPath = sourceFile
 
-	if diff {
-		err = s.diffEmbedded()
-	} else if extract {
-		err = s.extractEmbedded()
-	} else if extractIfMissing {
-		err = s.extractIfMissingEmbedded()
-	} else if embed {
-		err = s.embedEmbedded()
-	} else {
-		err = s.runScript()
-		if err != nil {
-			err = errors.New("running script failed to find compiled binary: " + err.Error())
+	var s *script.Script
+	if flag.Arg(0) == "init" {
+		err = initScript(flag.Args()[1:])
+	} else if flag.Arg(0) == "systemd-unit" {
+		err = systemdUnit(flag.Args()[1:], opts)
+	} else if flag.Arg(0) == "pack" {
+		err = packScript(flag.Args()[1:], opts)
+	} else if script.IsArchive(flag.Arg(0)) {
+		if embed || extract || extractIfMissing || len(getModules) > 0 || upgrade || tidy {
+			err = errors.New("an archive can't be changed, change the script it was packed from and pack it again")
+		} else {
+			s, err = script.OpenArchive(flag.Arg(0), opts)
 		}
-	}
-	if err != nil {
-		_, _ = fmt.Fprintln(os.Stderr, "error: "+err.Error())
-		os.Exit(1)
-	}
-}
-
-// initVars fills in commonly used variables (paths), e.g. what is the path to the script binary.
-// It reads the contents of the go script, to be able to extract the go.work section and also allow
-// any go.work "shared libraries" to be copied over to the temporary build area too.
-func (s *Script) initVars() (err error) {
-	hostname, err := os.Hostname()
-	if err != nil {
-		return
-	}
-	s.content, err = os.ReadFile(s.scriptPath)
-	if err != nil {
-		return
-	}
-
-	perUserTmpDir := fmt.Sprintf("gorun-%v-%v", hostname, os.Getuid())
-	tmpDir := filepath.Join(perUserTmpDir,
-		strings.ReplaceAll(s.scriptPath, string(filepath.Separator), "_"))
-
-	s.perUserTmpDir = filepath.Join(s.tmpDirBase, perUserTmpDir)
-	s.tmpDir = filepath.Join(s.tmpDirBase, tmpDir)
-	if strings.HasSuffix(s.scriptPath, ".go") {
-		s.scriptExtraDir = s.scriptPath[:len(s.scriptPath)-3] + "_"
 	} else {
-		s.scriptExtraDir = s.scriptPath + "_"
+		s, err = script.New(flag.Arg(0), opts)
+	}
+	if s != nil {
+		if check {
+			err = checkScript(s)
+		} else if diff {
+			err = diffEmbedded(s)
+		} else if explain {
+			err = explainScript(s)
+		} else if extract {
+			err = s.Extract()
+		} else if extractIfMissing {
+			err = s.ExtractIfMissing()
+		} else if embed {
+			err = s.Embed()
+		} else if len(getModules) > 0 {
+			err = printModuleChanges(s.Get(getModules...))
+		} else if upgrade {
+			err = printModuleChanges(s.Upgrade(patch))
+		} else if tidy {
+			err = tidyScript(s)
+		} else if watch {
+			err = watchScript(s, flag.Args()[1:])
+		} else if noRun {
+			err = s.Build()
+		} else {
+			err = s.Run(flag.Args()[1:]...)
+			if err != nil {
+				err = fmt.Errorf("running script failed to find compiled binary: %w", err)
+			}
+		}
 	}
-	fileinfo, err := os.Stat(s.scriptExtraDir)
-	if err != nil || !fileinfo.IsDir() {
-		err = nil
-		s.scriptExtraDir = ""
+	var buildErr *script.BuildError
+	if errors.As(err, &buildErr) && buildErr.Cached {
+		err = fmt.Errorf("%w (use -retryFailed to compile again)", err)
 	}
-	s.perRunTmpDirBase = filepath.Join(s.tmpDir, strconv.Itoa(os.Getpid()))
-	s.perRunTmpDir = filepath.Join(s.perRunTmpDirBase, filepath.Dir(s.scriptPath))
-	s.binary = filepath.Join(s.tmpDir, filepath.Base(s.scriptPath)+".bin")
-	s.binaryLastRun = filepath.Join(s.tmpDir, ".lastRun")
-
-	// deal with a go.work file
-	gowork := getSection(s.content, GOWORK)
-
-	// for each WorkFile.Path, we want to ignore ./* and copy any ../.* across
-	wf, err := modfile.ParseWork(GOWORK, gowork, nil)
 	if err != nil {
-		return
-	}
-	for _, w := range wf.Use {
-		if strings.HasPrefix(w.Path, "../") {
-			s.scriptRelWorkDirs = append(s.scriptRelWorkDirs, w.Path)
-			s.scriptWorkDirs = append(s.scriptWorkDirs, filepath.Join(filepath.Dir(s.scriptPath), w.Path))
+		logger.Error(err.Error(), "script", flag.Arg(0))
+		// always let the person (or cron) running gorun see why it failed, even if the log goes elsewhere
+		if !logToStderr {
+			_, _ = fmt.Fprintln(os.Stderr, "error: "+err.Error())
 		}
+		os.Exit(1)
 	}
-
-	return
 }
 
-// simplistic copy files from one directory to another, deleting files that no longer exist
-// given /tmp/path/<goscript>_ directory as dstDir and /path/<goscript>_ directory as srcDir
-func copyDir(dstDir string, srcDir string) (err error) {
-	err = filepath.Walk(srcDir, func(srcPath string, f os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		relPath, err := filepath.Rel(srcDir, srcPath)
-		switch f.Mode() & os.ModeType {
-		case 0: // Regular file
-			content, err := os.ReadFile(srcPath)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, "Failed to read (while copying) "+relPath+" to "+dstDir)
-				return err
-			}
-			err = os.WriteFile(filepath.Join(dstDir, relPath), content, 0600)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, "Failed to write (while copying) "+relPath+" to "+dstDir)
-				return err
-			}
-		case os.ModeDir:
-			os.Mkdir(filepath.Join(dstDir, relPath), 0700)
-			return nil
-		default:
-			return fmt.Errorf("We only handle regular files, not %s", relPath)
+// flagSet reports whether a flag was given on the command line (or GORUN_ARGS)
+func flagSet(name string) (set bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
 		}
-		return nil
 	})
-	if err != nil {
-		return err
-	}
 	return
 }
 
-// writeFileFromCommentsOrDir uses either the parsed commented section or the file on disc and copies it to the target dir
-func (s *Script) writeFileFromCommentsOrDir(content []byte, sectionName string) (err error) {
-	file := filepath.Join(s.perRunTmpDir, sectionName)
-	written, err := writeFileFromComments(content, sectionName, file)
-	if err != nil {
-		return
+// watchScript runs the script until interrupted, restarting it whenever it changes
+func watchScript(s *script.Script, args []string) (err error) {
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
 	}
-	if !written {
-		_ = copyDir(filepath.Join(s.perRunTmpDir, sectionName), filepath.Join(filepath.Dir(s.scriptPath), sectionName))
-	}
-	return
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return s.Watch(ctx, args...)
 }
 
-// updateTarget copies all needed files to build the script binary to the target area
-func (s *Script) updateTarget() (err error) {
-	os.RemoveAll(s.perRunTmpDirBase) // just in case it still exists
-	err = os.MkdirAll(s.perRunTmpDirBase, 0700)
+// diffEmbedded reports on stderr how each embedded section compares to the file on disc (or bundle manifest), failing
+// if any differ. Sections of the other scripts using a bundle name the script
+func diffEmbedded(s *script.Script) (err error) {
+	diffs, err := s.Diff()
 	if err != nil {
-		fmt.Printf("Failed to mkdirAll for %v. %v\n", s.perRunTmpDirBase, err.Error())
 		return
 	}
-
-	checkDirs := []string{}
-	if s.scriptExtraDir != "" {
-		checkDirs = append(checkDirs, s.scriptExtraDir)
-	}
-	checkDirs = append(checkDirs, s.scriptWorkDirs...)
-	for _, dir := range checkDirs {
-		src := dir
-		dest := filepath.Join(s.perRunTmpDirBase, dir)
-		err = os.MkdirAll(dest, 0700)
-		if err != nil {
-			fmt.Printf("Failed to mkdirAll on %v. %v\n", dest, err.Error())
-			return
+	inSync := true
+	for _, diff := range diffs {
+		level := "OK"
+		if !diff.InSync() {
+			level = "WARN"
+			inSync = false
 		}
-
-		err = copyDir(dest, src)
-		if err != nil {
-			fmt.Printf("Failed to copyDir %v\n", err.Error())
-			return
+		if diff.Script != s.Path() {
+			_, _ = fmt.Fprintf(os.Stderr, "%s: %v section %q %v\n", level, diff.Script, diff.Section, diff.Status)
+			continue
 		}
+		_, _ = fmt.Fprintf(os.Stderr, "%s: section %q %v\n", level, diff.Section, diff.Status)
 	}
-
-	// The go script must be made to end in ".go" to allow go build to work with it
-	dstScriptPath := filepath.Join(s.perRunTmpDir, filepath.Base(s.scriptPath))
-	if !strings.HasSuffix(s.scriptPath, ".go") {
-		dstScriptPath += ".go"
-	}
-
-	if len(s.content) > 2 && s.content[0] == '#' && s.content[1] == '!' {
-		s.content[0] = '/'
-		s.content[1] = '/'
-	}
-	err = os.MkdirAll(filepath.Dir(dstScriptPath), 0700)
-	if err != nil {
-		fmt.Printf("Failed to mkdirAll for %v. %v\n", filepath.Dir(dstScriptPath), err.Error())
-		return
-	}
-	err = os.WriteFile(dstScriptPath, s.content, 0600)
-	if err != nil {
-		return
-	}
-
-	// Write a go.mod file from inside the comments
-	err = s.writeFileFromCommentsOrDir(s.content, GOMOD)
-	if err != nil {
-		return
-	}
-
-	// Write a go.sum file from inside the comments
-	err = s.writeFileFromCommentsOrDir(s.content, GOSUM)
-	if err != nil {
-		return
+	if !inSync {
+		return errors.New("diffs found")
 	}
-
-	// Write a go.sum file from inside the comments
-	err = s.writeFileFromCommentsOrDir(s.content, GOWORK)
-	if err != nil {
-		return
-	}
-
-	// Write a go.sum file from inside the comments
-	err = s.writeFileFromCommentsOrDir(s.content, GOWORKSUM)
 	return
 }
 
-// run a command sending its output to stderr,stdout directly. Not used to run the script
-func runCommand(dir string, env []string, command string, args ...string) (err error) {
-	cmd := exec.Command(command, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Dir = dir
-	cmd.Env = env
-	err = cmd.Run()
-	if err != nil {
-		fmt.Printf("Run command %v %v failed with %s\n", command, args, err)
-	}
-	return
-}
-
-// getEnvVar returns the value of an environment variable from a slice of environment variables
-func getEnvVar(env []string, key string) string {
-
-	// Go through the list backwards so that we pick up the last version of any
-	// duplicate keys. This matches the behaviour of exec.Cmd.Env
-	for i := len(env) - 1; i >= 0; i-- {
-		line := env[i]
-		if strings.HasPrefix(line, key+"=") {
-			return strings.SplitAfterN(line, key+"=", 2)[1]
-		}
-	}
-	return ""
-}
-
-// goVer extracts a goversion from the output of a "go version %v" command
-func goVer(args []string, verPos int) (version string, err error) {
-	gobin, err := goBinaryPath()
+// tidyScript runs go mod tidy on the embedded module files, reporting on stderr if the script was updated
+func tidyScript(s *script.Script) (err error) {
+	changed, err := s.Tidy()
 	if err != nil {
 		return
 	}
-	var stdoutBuf bytes.Buffer
-	cmd := exec.Command(gobin, args...)
-	cmd.Stdout = &stdoutBuf
-	cmd.Env = os.Environ()
-	err = cmd.Run()
-	if err == nil {
-		versionArr := strings.Split(strings.TrimSuffix(stdoutBuf.String(), "\n"), " ")
-		if len(versionArr) >= 2 {
-			version = versionArr[len(versionArr)+verPos]
-		} else {
-			err = errors.New(fmt.Sprintf("unable to find version in %+v", versionArr))
-		}
+	if changed {
+		_, _ = fmt.Fprintf(os.Stderr, "%v: embedded %v/%v updated\n", s.Path(), script.GOMOD, script.GOSUM)
 	}
 	return
 }
 
-// compiledVersion returns the version of go used to compile a file
-func compiledVersion(filepath string) (fileVersion string, err error) {
-	// last entry is the version for a file:
-	// /tmp/gorun-myhost-0/_usr_local_bin_myFile.go/myFile.go.bin: go1.23.2
-	fileVersion, err = goVer([]string{"version", filepath}, -1)
-	return
-}
-
-// installedGoVersion returns the version of go installed on the system
-func installedGoVersion() (gobinVersion string, err error) {
-	// second last entry is the version for a file:
-	// go version go1.23.2 linux/amd64
-	gobinVersion, err = goVer([]string{"version"}, -2)
-	return
-}
-
-// goBinaryPath returns the path to the go binary
-func goBinaryPath() (gobin string, err error) {
-	// find the go binary to call via env var, std location, or the PATH
-	goRoot := runtime.GOROOT()
-	// Only use GOROOT if we have one, otherwise we end up with a relative path and os.Stat() will
-	// look in the working directory, which isn't the working dictionary later when we run the go bin.
-	if goRoot != "" {
-		gobin = filepath.Join(runtime.GOROOT(), "bin", "go")
-		if _, err := os.Stat(gobin); err == nil {
-			return gobin, nil
+// parseScriptName parses the flags of a subcommand taking one script name, the flags may come before or after it
+func parseScriptName(flags *flag.FlagSet, args []string) (name string, err error) {
+	var names []string
+	for {
+		if err = flags.Parse(args); err != nil {
+			return
 		}
-	}
-
-	// Look in the PATH
-	if gobin, err = exec.LookPath("go"); err == nil {
-		return gobin, nil
-	}
-	return gobin, errors.New(fmt.Sprintf("can't find go tool in GOROOT (%s) or PATH (%s)", goRoot, os.Getenv("PATH")))
-}
-
-// compile copies the script and its dependencies to a "per run" tmp directory and compiles it there.
-// The binary is kept, but the "per run" tmp directory is removed at the end
-func (s *Script) compile() (err error) {
-	if !s.debug {
-		defer os.RemoveAll(s.perRunTmpDirBase)
-	}
-	err = s.updateTarget()
-	if err != nil {
-		return
-	}
-	s.waitForActiveBuilds()
-	// maybe it was built while we were waiting?
-	outOfDate, err := s.targetOutOfDate()
-	if err == nil && !outOfDate {
-		return
-	}
-
-	// use the default environment before adding our overrides, this allows GOPRIVATE etc. to be used in the build
-	var env []string
-	section := getSection(s.content, "go.env")
-	env = os.Environ()
-	if len(section) > 0 {
-		env = append(env, strings.Split(string(section), "\n")...)
-	}
-
-	// if $HOME/.cache can't be built and $GOCACHE is not set, then use a temp home dir
-	if getEnvVar(env, "GOCACHE") == "" {
-		home := getEnvVar(env, "HOME")
-		if home == "" || home == "/" {
-			env = append(env, "HOME="+s.perRunTmpDir)
-		} else if _, err := os.Stat(filepath.Join(home, ".cache")); os.IsNotExist(err) {
-			err = os.Mkdir(filepath.Join(home, ".cache"), 0755)
-			if err != nil && !os.IsExist(err) {
-				// unable to create the .cache directory - give this process a temp home (env will likely contain HOME twice)
-				env = append(env, "HOME="+s.perRunTmpDir)
-			}
+		if flags.NArg() == 0 {
+			break
 		}
+		names = append(names, flags.Arg(0))
+		args = flags.Args()[1:]
 	}
-	// custom directory for temporary files used during Go builds. Put it alongside the final binary so it can be auto-cleaned
-	env = append(env, "GOTMPDIR="+s.tmpDir)
-
-	gobin, err := goBinaryPath()
-	if err != nil {
-		return err
-	}
-
-	out := filepath.Join(s.perRunTmpDir, filepath.Base(s.scriptPath)+".bin")
-
-	err = runCommand(s.perRunTmpDir, env,
-		gobin, "build", "-o", out, ".")
-	if err != nil {
-		return err
+	if len(names) != 1 {
+		return "", fmt.Errorf("gorun %v needs exactly one script name", flags.Name())
 	}
-	err = os.Rename(out, s.binary)
-	// os.RemoveAll mode 444 files (from go build cache being here when no HOME dir set) on Unix don't allow unlink
-	// so let's chmod all files/dirs to allow the deferred RemoveAll to work
-	_ = filepath.Walk(s.perRunTmpDirBase, func(name string, info os.FileInfo, err error) error {
-		if err == nil {
-			err = os.Chmod(name, 0755)
-		}
-		return err
-	})
-	return
+	return names[0], nil
 }
 
-// isProcessRunning checks if a process with the given PID is still running
-func isProcessRunning(pid int) bool {
-	process, err := os.FindProcess(pid)
-	if err != nil {
-		return false
-	}
-	// On Unix, FindProcess always succeeds, so we need to send signal 0 to check if process exists
-	err = process.Signal(syscall.Signal(0))
-	return err == nil
+// newInitFlags returns the flags for 'gorun init'
+func newInitFlags(opts *script.InitOptions, shebang *bool, binfmt *bool) *flag.FlagSet {
+	flags := flag.NewFlagSet("init", flag.ContinueOnError)
+	flags.StringVar(&opts.Module, "module", "", "module name for the embedded go.mod, defaults to the script's base name")
+	flags.BoolVar(shebang, "shebang", false, "make the script executable with a '#!/usr/bin/env gorun' first line")
+	flags.BoolVar(binfmt, "binfmt", false, "make the script executable with a '"+script.BinfmtLine+"' first line, see gorun-register.sh")
+	flags.BoolVar(&opts.ExtraDir, "extraDir", false, "also create the extra source directory, the script name with a trailing '_'")
+	return flags
 }
 
-// hasActiveBuild checks if there are any active compilation processes for this script
-// by looking for PID directories in s.tmpDir and checking if those processes are still running
-// even if they are, we will continue if we are the lowest PID
-func (s *Script) hasActiveBuild() bool {
-	entries, err := os.ReadDir(s.tmpDir)
+// initScript writes a new script for 'gorun init name.go', the flags may come before or after the name
+func initScript(args []string) (err error) {
+	var opts script.InitOptions
+	var shebang, binfmt bool
+	flags := newInitFlags(&opts, &shebang, &binfmt)
+	name, err := parseScriptName(flags, args)
 	if err != nil {
-		return false // If we can't read the directory, assume no active builds
-	}
-
-	currentPID := os.Getpid()
-	for _, entry := range entries {
-		if entry.IsDir() {
-			// Check if the directory name is numeric (PID)
-			if pid, err := strconv.Atoi(entry.Name()); err == nil {
-				// Skip our own PID
-				if pid != currentPID && isProcessRunning(pid) {
-					if pid < currentPID {
-						if s.debug {
-							_, _ = fmt.Fprintf(os.Stdout, "[%v] Detected lower active build process with PID %d\n", currentPID, pid)
-						}
-						return true
-					}
-				}
-			}
-		}
-	}
-	return false
-}
-
-// waitForActiveBuilds waits for any lower PID active builds to complete before proceeding
-// Returns true if it's safe to proceed, false if timeout occurred.
-func (s *Script) waitForActiveBuilds() bool {
-	maxRetries := 12 //  Waits max approx 17s at 12 iterations. But may be called twice, so 34s total.
-	waitTime := 100 * time.Millisecond
-	maxWaitTime := 2 * time.Second
-
-	for i := 0; i < maxRetries; i++ {
-		if !s.hasActiveBuild() {
-			return true
-		}
-
-		if s.debug {
-			_, _ = fmt.Fprintf(os.Stderr, "Active build detected, waiting %v (attempt %d/%d)\n", waitTime, i+1, maxRetries)
-		}
-
-		time.Sleep(waitTime)
-		outOfDate, err := s.targetOutOfDate()
-		if err == nil && !outOfDate {
-			_, _ = fmt.Fprintf(os.Stderr, "Active build detected, escaping %v (attempt %d/%d)\n", waitTime, i+1, maxRetries)
-			return false
-		}
-
-		// Exponential backoff, but cap at maxWaitTime
-		waitTime *= 2
-		if waitTime > maxWaitTime {
-			waitTime = maxWaitTime
-		}
+		return
 	}
-
-	// Timeout occurred, but we'll proceed anyway
-	if s.debug {
-		_, _ = fmt.Fprintf(os.Stderr, "Timeout waiting for active builds, proceeding anyway\n")
+	if shebang && binfmt {
+		return errors.New("only one of -shebang and -binfmt can be used")
+	} else if shebang {
+		opts.FirstLine = script.FirstLineShebang
+	} else if binfmt {
+		opts.FirstLine = script.FirstLineBinfmt
 	}
-	return false
-}
-
-func touchFile(file string, onlyIfExists bool) (err error) {
-	_, err = os.Stat(file)
-	if os.IsNotExist(err) {
-		if !onlyIfExists {
-			var f *os.File
-			f, err = os.Create(file)
-			defer f.Close()
-		}
-	} else {
-		currentTime := time.Now().Local()
-		err = os.Chtimes(file, currentTime, currentTime)
-	}
-	return
-}
-
-// run runs the binary and marks when it was last run (by touching a file alongside the binary)
-func (s *Script) run() (err error) {
-	if s.cleanSecs >= 0 {
-		_ = touchFile(s.binaryLastRun, false)
-		_ = touchFile(s.binary, true)
+	err = script.Init(name, opts)
+	if err == nil {
+		_, _ = fmt.Fprintf(os.Stderr, "created %v\n", name)
 	}
-	err = syscall.Exec(s.binary, s.args, os.Environ())
 	return
 }
 
-// remove binaries that haven't been accessed for a while.
-// Check a file in each directory to see when it was last touched (last run)
-// Also remove any per-process build and cache directories that are older than cleanSecsBuildDirs
-func (s *Script) clean() (err error) {
-	perUserDir, err := os.Open(s.perUserTmpDir)
-	if err != nil {
-		return
-	}
-	infos, err := perUserDir.Readdir(-1)
-	if err != nil {
-		return
-	}
-	cutoffTime := time.Now().Add(time.Duration(-s.cleanSecs) * time.Second)
-	buildDirCutoffTime := time.Now().Add(time.Duration(-s.cleanSecsBuildDirs) * time.Second)
-
-	for _, info := range infos {
-		if info.IsDir() {
-			scriptDir := filepath.Join(s.perUserTmpDir, info.Name())
-
-			// Check and clean the binary if it hasn't been accessed recently
-			st, err := os.Stat(filepath.Join(scriptDir, ".lastRun"))
-			if !os.IsNotExist(err) && st.ModTime().Before(cutoffTime) {
-				os.RemoveAll(scriptDir)
-				continue // Directory removed, skip build dir cleanup
-			}
-
-			// Clean up old build directories (per-process directories left behind by crashes)
-			buildDirs, err := os.ReadDir(scriptDir)
-			if err != nil {
-				continue // Skip if we can't read the directory
-			}
-			for _, buildDir := range buildDirs {
-				if buildDir.IsDir() {
-					isPIDDir := false
-					// Check if the directory name is numeric (PID)
-					if _, err := strconv.Atoi(buildDir.Name()); err == nil {
-						isPIDDir = true
-					}
-					if strings.HasPrefix(buildDir.Name(), "go-build") || isPIDDir {
-						buildDirPath := filepath.Join(scriptDir, buildDir.Name())
-						buildDirInfo, err := buildDir.Info()
-						if err == nil && buildDirInfo.ModTime().Before(buildDirCutoffTime) {
-							os.RemoveAll(buildDirPath)
-						}
-					}
-				}
-			}
+// newUnitFlags returns the flags for 'gorun systemd-unit'
+func newUnitFlags(opts *script.UnitOptions, gorunArgs *string) *flag.FlagSet {
+	flags := flag.NewFlagSet("systemd-unit", flag.ContinueOnError)
+	flags.StringVar(&opts.User, "user", "", "user the script runs as, defaults to a transient user (DynamicUser=yes)")
+	flags.StringVar(&opts.Description, "description", "", "description of the unit, defaults to the script path")
+	flags.StringVar(&opts.Gorun, "gorun", "", "path to gorun in the unit, defaults to this gorun")
+	flags.StringVar(gorunArgs, "gorunArgs", "", "gorun options the unit runs the script with (GORUN_ARGS), e.g. '-fallbackLastGood'")
+	return flags
+}
+
+// systemdUnit prints a systemd service unit for 'gorun systemd-unit name.go [-- args]', the flags may come before or
+// after the name
+func systemdUnit(args []string, opts script.Options) (err error) {
+	var unitOpts script.UnitOptions
+	var gorunArgs string
+	for i, arg := range args {
+		if arg == "--" {
+			args, unitOpts.Args = args[:i], args[i+1:]
+			break
 		}
 	}
-	return nil
-}
-
-// targetOutOfDate returns if the target needs recompiled, is the source newer than the binary or go version is "too old"?
-func (s *Script) targetOutOfDate() (outOfDate bool, err error) {
-	// target doesn't exist?
-	binaryInfo, binStatErr := os.Stat(s.binary)
-	if binStatErr != nil {
-		return true, nil
-	}
-
-	oldestSrcInfo, err := os.Stat(s.scriptPath)
+	flags := newUnitFlags(&unitOpts, &gorunArgs)
+	name, err := parseScriptName(flags, args)
 	if err != nil {
 		return
 	}
-	// if we have any extra source directories, check whether any are newer than the binary.
-	checkDirs := []string{}
-	if s.scriptExtraDir != "" {
-		checkDirs = append(checkDirs, s.scriptExtraDir)
-	}
-	checkDirs = append(checkDirs, s.scriptWorkDirs...)
-	for _, checkDir := range checkDirs {
-		err = filepath.Walk(checkDir, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				_, _ = fmt.Fprintf(os.Stderr, "FATAL: Unable to find dependency: %v\n", path)
-				return err
-			}
-			if info.ModTime().After(oldestSrcInfo.ModTime()) {
-				oldestSrcInfo = info
-			}
-			return nil
-		})
-		if err != nil {
-			return true, err
-		}
-	}
-
-	outOfDate = binaryInfo.IsDir() || binaryInfo.ModTime().Before(oldestSrcInfo.ModTime())
-
-	// check the binary was compiled with the same version of go installed on the system.
-	// we have seen binaries filled with zeros on unclean shutdowns, this first stage should also catch that, so
-	// run it outside the s.recompileWrongGoVer check.
-	fileVersion, err := compiledVersion(s.binary)
-	if err != nil {
-		// recompile in case it is a corrupt binary but not pollute its stdout/stderr
-		outOfDate = true
-	} else if !outOfDate && s.recompileWrongGoVer {
-		// If not, further check if the binary was compiled with the version of go installed on the system
-		gobinVersion, err := installedGoVersion()
-		if err != nil {
-			// we couldn't run "go version" for some reason, let's fail now
-			return true, err
+	unitOpts.GorunArgs = strings.Fields(gorunArgs)
+	if unitOpts.Gorun == "" {
+		if unitOpts.Gorun, err = os.Executable(); err != nil {
+			return
 		}
-		outOfDate = (gobinVersion != fileVersion)
 	}
-	return outOfDate, nil
-}
-
-// runScript compiles if required, and then runs the binary created from the script
-func (s *Script) runScript() (err error) {
-	err = s.initVars()
+	s, err := script.New(name, opts)
 	if err != nil {
 		return
 	}
-
-	if s.cleanSecs >= 0 {
-		s.clean()
-	}
-	// we could be getting called multiple times simultaneously, with source code changing under
-	// our feet too. We could also get our directory deleted entirely from under us as part of
-	// a clean up, so let's try multiple times
-	var outOfDate bool
-	for i := 0; i < 5; i++ {
-		outOfDate, err = s.targetOutOfDate()
-		if err != nil {
-			return // can't find the source file - let's bail
-		}
-
-		if outOfDate {
-			// Wait for any active builds to complete before starting our own
-			s.waitForActiveBuilds()
-			// maybe it was built while we were waiting?
-			outOfDate, err = s.targetOutOfDate()
-			if err != nil {
-				return // can't find the source file - let's bail
-			}
-			if outOfDate {
-				err = s.compile() // can't compile, well, it could be inconsistent source, let's bail
-				if err != nil {
-					return
-				}
-			}
-		}
-		if !s.noRun {
-			err = s.run()
-		}
-		if !os.IsNotExist(err) {
-			break // we ran, must be a real error
-		}
-	}
-	return
-}
-
-//
-// Helpers to embed, extract and diff go.mod/go.sum files between filesystem and comments within the script.
-//
-
-// loadFile loads a file from disc, removing extra new lines and spaces
-func loadFile(filename string) (found bool, content []byte, err error) {
-	_, err = os.Stat(filename)
+	unit, err := s.SystemdUnit(unitOpts)
 	if err != nil {
-		return false, nil, nil // no error if file not there
-	}
-	content, err = os.ReadFile(filename)
-	if err != nil {
-		return // error if file there but can't be read
+		return
 	}
-	found = true
-	// get rid of extra new lines and whitespace
-	content = bytes.TrimSpace(content)
-	content = bytes.Replace(content, []byte("\n\n"), []byte("\n"), -1)
+	_, err = os.Stdout.Write(unit)
 	return
 }
 
-func diffBytes(content []byte, dir string, sectionName string) (diff string, err error) {
-	section := getSection(content, sectionName)
-	section = bytes.TrimSpace(section)
-	section = bytes.Replace(section, []byte("\n\n"), []byte("\n"), -1)
-
-	foundOnDisc, sectionFromFile, err := loadFile(filepath.Join(dir, sectionName))
-	if err != nil { // file exists but unable to read
-		return
-	}
-	if !foundOnDisc && len(section) == 0 {
-		_, _ = fmt.Fprintf(os.Stderr, "OK: section %q not embedded or on disc\n", sectionName)
-		return "", nil
-	}
-	if !foundOnDisc {
-		_, _ = fmt.Fprintf(os.Stderr, "WARN: embedded %q exists but nothing on disc\n", sectionName)
-		return "embeddedExists", nil
-	}
-	if len(section) == 0 && len(sectionFromFile) > 0 {
-		_, _ = fmt.Fprintf(os.Stderr, "WARN: on disc %q exists but embedded doesn't\n", sectionName)
-		return "discExists", nil
-	}
-	if bytes.Equal(sectionFromFile, section) {
-		_, _ = fmt.Fprintf(os.Stderr, "OK: embedded %q exists and same as on disc\n", sectionName)
-		return "", nil
-	}
-	_, _ = fmt.Fprintf(os.Stderr, "WARN: embedded %q exists and different to on disc\n", sectionName)
-	return "diff", nil
+// newPackFlags returns the flags for 'gorun pack'
+func newPackFlags(out *string) *flag.FlagSet {
+	flags := flag.NewFlagSet("pack", flag.ContinueOnError)
+	flags.StringVar(out, "o", "", "archive to write, a .zip, .tar.gz or (the default) a .gorun file that can be run directly. Defaults to the script's base name plus .gorun")
+	return flags
 }
 
-func (s *Script) diffEmbedded() (err error) {
-	content, err := os.ReadFile(s.scriptPath)
+// packScript writes an archive of a script for 'gorun pack name.go', the flags may come before or after the name
+func packScript(args []string, opts script.Options) (err error) {
+	var out string
+	flags := newPackFlags(&out)
+	name, err := parseScriptName(flags, args)
 	if err != nil {
 		return
 	}
-	diff1, err := diffBytes(content, filepath.Dir(s.scriptPath), GOMOD)
-	if err != nil {
-		return
+	if out == "" {
+		out = strings.TrimSuffix(filepath.Base(name), ".go") + ".gorun"
 	}
-	diff2, err := diffBytes(content, filepath.Dir(s.scriptPath), GOSUM)
+	s, err := script.New(name, opts)
 	if err != nil {
 		return
 	}
-	diff3, err := diffBytes(content, filepath.Dir(s.scriptPath), GOWORK)
-	if err != nil {
-		return
-	}
-	diff4, err := diffBytes(content, filepath.Dir(s.scriptPath), GOWORKSUM)
-	if err != nil {
-		return
-	}
-
-	if diff1 != "" || diff2 != "" || diff3 != "" || diff4 != "" {
-		_, _ = fmt.Fprintln(os.Stderr, "Diffs found")
-		os.Exit(1)
+	if err = s.Pack(out); err == nil {
+		_, _ = fmt.Fprintf(os.Stderr, "packed %v in to %v\n", s.Path(), out)
 	}
 	return
 }
 
-func (s *Script) extractEmbedded() (err error) {
-	content, err := os.ReadFile(s.scriptPath)
+// printModuleChanges prints a summary of the module versions changed by -get or -upgrade
+func printModuleChanges(changes []script.ModuleChange, err error) error {
 	if err != nil {
-		return
-	}
-	_, err = writeFileFromComments(content, GOSUM, filepath.Join(filepath.Dir(s.scriptPath), GOSUM))
-
-	if err != nil {
-		return
-	}
-	_, err = writeFileFromComments(content, GOMOD, filepath.Join(filepath.Dir(s.scriptPath), GOMOD))
-	if err != nil {
-		return
+		return err
 	}
-	if len(getSection(content, GOWORK)) != 0 {
-		_, err = writeFileFromComments(content, GOWORK, filepath.Join(filepath.Dir(s.scriptPath), GOWORK))
-		if err != nil {
-			return
-		}
+	if len(changes) == 0 {
+		fmt.Println("no module versions changed")
 	}
-	if len(getSection(content, GOWORKSUM)) != 0 {
-		_, err = writeFileFromComments(content, GOWORKSUM, filepath.Join(filepath.Dir(s.scriptPath), GOWORKSUM))
-		if err != nil {
-			return
-		}
+	for _, change := range changes {
+		fmt.Println(change)
 	}
-	return
-}
-
-func commentSection(content []byte, header string, trailer string) (commented []byte) {
-	commented = bytes.ReplaceAll(content, []byte("\n"), []byte("\n// :"))
-	commented = append(commented, []byte("\n")...)
-	commented = append([]byte("// :"), commented...)
-	commented = append([]byte(header), commented...)
-	commented = append(commented, []byte(trailer)...)
-	return
-}
-
-// header transforms a section name, e.g. 'go.mod' in to a header comment, e.g. '// go.mod >>>\n'
-func header(section string) (header string) {
-	return "// " + section + " >>>\n"
-}
-
-// trailer transforms a section name, e.g. 'go.mod' in to a trailer comment, e.g. '// <<< go.mod\n'
-func trailer(section string) (trailer string) {
-	return "// <<< " + section + "\n"
+	return nil
 }
 
-// extract the files go.sum, go.mod from the comments at the top of the script and put on disc
-// ONLY if they both don't already exist on disc.
-func (s *Script) extractIfMissingEmbedded() (err error) {
-	foundSumOnDisc, _, err := loadFile(filepath.Join(filepath.Dir(s.scriptPath), GOSUM))
-	if err != nil {
-		return
-	}
-	foundModOnDisc, _, err := loadFile(filepath.Join(filepath.Dir(s.scriptPath), GOMOD))
-	if err != nil {
-		return
+// checkScript reports every problem with the embedded sections on stderr, as file:line: message. Warnings alone
+// don't fail the check
+func checkScript(s *script.Script) (err error) {
+	err = s.Check()
+	errs := flattenErrors(err)
+	if err == nil {
+		errs = nil
 	}
-	foundWorkOnDisc, _, err := loadFile(filepath.Join(filepath.Dir(s.scriptPath), GOWORK))
-	if err != nil {
-		return
+	line := func(e error) int {
+		var parseErr *script.ParseError
+		if errors.As(e, &parseErr) {
+			return parseErr.Line
+		}
+		return 0
+	}
+	sort.SliceStable(errs, func(i, j int) bool { return line(errs[i]) < line(errs[j]) })
+	failed := false
+	for _, e := range errs {
+		var parseErr *script.ParseError
+		if errors.As(e, &parseErr) && parseErr.Warning {
+			_, _ = fmt.Fprintf(os.Stderr, "%v:%d: warning: %v\n", s.Path(), parseErr.Line, parseErr.Msg)
+			continue
+		}
+		failed = true
+		if errors.As(e, &parseErr) {
+			_, _ = fmt.Fprintf(os.Stderr, "%v:%d: %v\n", s.Path(), parseErr.Line, parseErr.Msg)
+		} else {
+			_, _ = fmt.Fprintf(os.Stderr, "%v: %v\n", s.Path(), e)
+		}
 	}
-	foundWorkSumOnDisc, _, err := loadFile(filepath.Join(filepath.Dir(s.scriptPath), GOWORKSUM))
-	if err != nil {
-		return
+	if failed {
+		return errors.New("invalid embedded sections")
 	}
-
-	if !foundModOnDisc && !foundSumOnDisc && !foundWorkOnDisc && !foundWorkSumOnDisc {
-		s.extractEmbedded()
-	}
-	return
+	_, _ = fmt.Fprintf(os.Stderr, "OK: %v sections are valid\n", s.Path())
+	return nil
 }
 
-// embed the files go.sum, go.mod in the comments at the top of the script (go.work is optional)
-func (s *Script) embedEmbedded() (err error) {
-	content, err := os.ReadFile(s.scriptPath)
-	if err != nil {
+// flattenErrors returns the individual errors from (possibly nested) errors.Join errors
+func flattenErrors(err error) (errs []error) {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range joined.Unwrap() {
+			errs = append(errs, flattenErrors(e)...)
+		}
 		return
 	}
-	foundSumOnDisc, sumContent, err := loadFile(filepath.Join(filepath.Dir(s.scriptPath), GOSUM))
+	return []error{err}
+}
+
+// explainScript prints every reason the script would be recompiled, without building or running anything
+func explainScript(s *script.Script) (err error) {
+	reasons, err := s.Explain()
 	if err != nil {
 		return
 	}
-	foundModOnDisc, modContent, err := loadFile(filepath.Join(filepath.Dir(s.scriptPath), GOMOD))
-	if err != nil {
+	binary, _ := s.Binary()
+	if len(reasons) == 0 {
+		fmt.Printf("%v: up to date (%v)\n", s.Path(), binary)
 		return
 	}
-	foundWorkOnDisc, workContent, _ := loadFile(filepath.Join(filepath.Dir(s.scriptPath), GOWORK))
-	foundWorkSumOnDisc, workSumContent, _ := loadFile(filepath.Join(filepath.Dir(s.scriptPath), GOWORKSUM))
-
-	// let's only delete an embedded section if there is a section file (e.g. go.sum) on disc alongside
-	if foundModOnDisc {
-		_, content = embedSection(content, modContent, GOMOD, []string{})
-	}
-
-	if foundSumOnDisc {
-		_, content = embedSection(content, sumContent, GOSUM, []string{GOMOD})
-	}
-
-	if foundWorkOnDisc {
-		_, content = embedSection(content, workContent, GOWORK, []string{GOMOD, GOSUM})
-	}
-
-	if foundWorkSumOnDisc {
-		_, content = embedSection(content, workSumContent, GOWORKSUM, []string{GOMOD, GOSUM, GOWORK})
-	}
-
-	err = os.WriteFile(s.scriptPath, content, 0600)
-	return
-}
-
-// replace a commented section of bytes with another commented section of bytes, returning the new entire file contents
-// return idx = -1 if not found
-func embedSection(origContent []byte, sectionBytes []byte, section string, previousSections []string) (foundIdx int, content []byte) {
-	addNewline := false
-	// if we found the section, put the new one where the old one was
-	foundIdx, content = removeSection(origContent, section)
-	idx := foundIdx
-	if foundIdx < 0 { // if we failed to find the section, place it after any sections we want before it
-		idx = 0
-		for _, prevSection := range previousSections {
-			found, _, _, _, foundIdx := sectionIndexes(content, prevSection)
-			if found && foundIdx > idx {
-				idx = foundIdx
-				addNewline = true
-			}
-		}
-	}
-	var contentStart, contentTrailer []byte
-
-	contentStart = append(contentStart, content[0:idx]...)
-	// only add a newline between sections go.sum and go.mod sections if we've added a new (e.g. go.sum) section
-	// after an existing section (e.g. go.mod), otherwise leave it as the user had it
-	if addNewline {
-		contentStart = append(contentStart, []byte("\n")...)
+	fmt.Printf("%v: would be recompiled because:\n", s.Path())
+	for _, reason := range reasons {
+		fmt.Printf("  - %v\n", reason)
 	}
-	contentTrailer = append(contentTrailer, content[idx:]...)
-	content = append(contentStart, commentSection(sectionBytes, header(section), trailer(section))...)
-	content = append(content, contentTrailer...)
 	return
 }
 
-// sectionIndexes returns whether a section is found and if so, the indexes of start, end, etc.
-// found true iff a section called sectionName is found
-// startIdx is the first byte of the header for this section
-// endIdx is the byte after the trailer for this section.
-// InnerIdx mark the start and end of the real content for this section
-func sectionIndexes(content []byte, sectionName string) (found bool, startIdx int, startInnerIdx int, endInnerIdx int, endIdx int) {
-	start := header(sectionName)
-	end := trailer(sectionName)
-	startIdx = bytes.Index(content, []byte(start))
-	startInnerIdx = startIdx + len(start)
-	endInnerIdx = bytes.Index(content, []byte(end))
-	endIdx = endInnerIdx + len(end)
-	found = startIdx >= 0 && endIdx > startIdx
-	return
-}
-
-// getSection finds, removes comments, and returns the comment section embedded in a file, or empty if not found
-func getSection(content []byte, sectionName string) (section []byte) {
-	found, _, startInnerIdx, endInnerIdx, _ := sectionIndexes(content, sectionName)
-	if found {
-		sectionString := "\n" + string(content[startInnerIdx:endInnerIdx])
-		// Handle scripts both with and without the : prefix
-		sectionString = strings.ReplaceAll(sectionString, "\n// :", "\n")
-		// If we haven't removed anything try the old format
-		if len(sectionString) == endInnerIdx-startInnerIdx+1 {
-			sectionString = strings.ReplaceAll(sectionString, "\n// ", "\n")
+// newLogger creates the logger used for all of gorun's own diagnostics. It never writes to stdout, as that
+// belongs to the script being run. logToStderr reports whether the messages end up on stderr.
+func newLogger(level string, format string, file string) (logger *slog.Logger, logToStderr bool, err error) {
+	var lvl slog.Level
+	if err = lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, false, fmt.Errorf("invalid -log-level %q: %w", level, err)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	var newHandler func(w io.Writer) slog.Handler
+	switch format {
+	case "text":
+		newHandler = func(w io.Writer) slog.Handler { return slog.NewTextHandler(w, opts) }
+	case "json":
+		newHandler = func(w io.Writer) slog.Handler { return slog.NewJSONHandler(w, opts) }
+	default:
+		return nil, false, fmt.Errorf("invalid -log-format %q, must be text or json", format)
+	}
+
+	var handler slog.Handler
+	switch file {
+	case "":
+		logToStderr = true
+		handler = newHandler(os.Stderr)
+	case "syslog":
+		handler, err = newSyslogHandler(newHandler)
+		if err != nil {
+			return nil, false, fmt.Errorf("unable to connect to syslog: %w", err)
 		}
-		return []byte(sectionString)
-	}
-	return []byte("")
-}
-
-// removeSection removes a commented section from the contents of the entire file, returning the new contents and where it was removed from
-func removeSection(content []byte, sectionName string) (startIdx int, newContent []byte) {
-	found, startIdx, _, _, endIdx := sectionIndexes(content, sectionName)
-	if found {
-		newContent = content[0:startIdx]
-		newContent = append(newContent, content[endIdx:]...)
-	} else {
-		newContent = content
-	}
-	return
-}
-
-// writeFileFromComments write out a particular commented section of a goscript file to a file
-func writeFileFromComments(content []byte, sectionName string, file string) (written bool, err error) {
-	// Write a go.mod file from inside the comments
-	section := getSection(content, sectionName)
-	if len(section) > 0 {
-		err = os.WriteFile(file, section, 0600)
+	default:
+		w, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "Failed to write "+sectionName+" to "+file)
-			return
+			return nil, false, fmt.Errorf("unable to open -log-file: %w", err)
 		}
-		written = true
+		handler = newHandler(w)
 	}
-	return
+	return slog.New(handler).With("pid", os.Getpid()), logToStderr, nil
 }
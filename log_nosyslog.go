@@ -0,0 +1,14 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+)
+
+// newSyslogHandler is unavailable on this platform
+func newSyslogHandler(newHandler func(w io.Writer) slog.Handler) (slog.Handler, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
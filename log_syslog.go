@@ -0,0 +1,71 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"strings"
+	"sync"
+)
+
+// newSyslogHandler connects to the local syslog daemon (journald picks these up too on systemd hosts), logging each
+// record at the priority of its level, formatted by the handler newHandler returns
+func newSyslogHandler(newHandler func(w io.Writer) slog.Handler) (slog.Handler, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_USER, "gorun")
+	if err != nil {
+		return nil, err
+	}
+	return newPriorityHandler(w, newHandler), nil
+}
+
+// priorityWriter writes a message at a syslog priority, as *syslog.Writer does
+type priorityWriter interface {
+	Err(m string) error
+	Warning(m string) error
+	Info(m string) error
+	Debug(m string) error
+}
+
+// priorityHandler formats a record in to buf then writes it at the priority of its level
+type priorityHandler struct {
+	slog.Handler // writes to buf
+	w            priorityWriter
+	mu           *sync.Mutex // guards buf, shared by the handlers made by WithAttrs and WithGroup
+	buf          *bytes.Buffer
+}
+
+func newPriorityHandler(w priorityWriter, newHandler func(w io.Writer) slog.Handler) *priorityHandler {
+	buf := &bytes.Buffer{}
+	return &priorityHandler{Handler: newHandler(buf), w: w, mu: &sync.Mutex{}, buf: buf}
+}
+
+func (h *priorityHandler) Handle(ctx context.Context, r slog.Record) (err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buf.Reset()
+	if err = h.Handler.Handle(ctx, r); err != nil {
+		return
+	}
+	msg := strings.TrimSuffix(h.buf.String(), "\n")
+	switch {
+	case r.Level >= slog.LevelError:
+		return h.w.Err(msg)
+	case r.Level >= slog.LevelWarn:
+		return h.w.Warning(msg)
+	case r.Level >= slog.LevelInfo:
+		return h.w.Info(msg)
+	}
+	return h.w.Debug(msg)
+}
+
+func (h *priorityHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &priorityHandler{Handler: h.Handler.WithAttrs(attrs), w: h.w, mu: h.mu, buf: h.buf}
+}
+
+func (h *priorityHandler) WithGroup(name string) slog.Handler {
+	return &priorityHandler{Handler: h.Handler.WithGroup(name), w: h.w, mu: h.mu, buf: h.buf}
+}
@@ -0,0 +1,56 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"reflect"
+	"testing"
+)
+
+// priorities records the messages written at each priority
+type priorities []string
+
+func (p *priorities) write(priority string, m string) error {
+	*p = append(*p, priority+" "+m)
+	return nil
+}
+
+func (p *priorities) Err(m string) error     { return p.write("err", m) }
+func (p *priorities) Warning(m string) error { return p.write("warning", m) }
+func (p *priorities) Info(m string) error    { return p.write("info", m) }
+func (p *priorities) Debug(m string) error   { return p.write("debug", m) }
+
+func TestPriorityHandler(t *testing.T) {
+	var got priorities
+	logger := slog.New(newPriorityHandler(&got, func(w io.Writer) slog.Handler {
+		return slog.NewTextHandler(w, &slog.HandlerOptions{
+			Level: slog.LevelDebug,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if a.Key == slog.TimeKey {
+					return slog.Attr{}
+				}
+				return a
+			},
+		})
+	})).With("pid", 1)
+	logger.Debug("compiling")
+	logger.Info("compiled", "script", "a.go")
+	logger.Warn("slow")
+	logger.Error("failed")
+	logger.Log(context.Background(), slog.LevelError+4, "worse")
+	logger.WithGroup("g").Info("grouped", "k", "v")
+	want := priorities{
+		"debug level=DEBUG msg=compiling pid=1",
+		"info level=INFO msg=compiled pid=1 script=a.go",
+		"warning level=WARN msg=slow pid=1",
+		"err level=ERROR msg=failed pid=1",
+		"err level=ERROR+4 msg=worse pid=1",
+		"info level=INFO msg=grouped pid=1 g.k=v",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n%q\nwant\n%q", got, want)
+	}
+}
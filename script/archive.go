@@ -0,0 +1,356 @@
+package script
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ARCHIVE is the manifest written at the top of an archive by Pack, naming the script within it (relative, with '/'
+// separators) and the directory its files were packed from, e.g.
+//
+//	script tools/deploy.go
+//	root /home/me/src
+//
+// so absolute go.work and go.mod paths under root can be found once unpacked
+const ARCHIVE = "gorun.archive"
+
+// ArchiveHeader starts a .gorun archive, a gzipped tar follows it. The first line lets the archive be run directly
+const ArchiveHeader = "#!/usr/bin/env gorun\n# gorun archive, a gzipped tar follows\n"
+
+// Archive formats, detected from their content by archiveFormat and chosen from the file name by Pack
+const (
+	ArchiveGorun = "gorun"  // ArchiveHeader then a gzipped tar
+	ArchiveTarGz = "tar.gz" // a gzipped tar
+	ArchiveZip   = "zip"
+)
+
+// archivesDir is the directory, in the per user dir, archives are unpacked in to. It can't be mistaken for a script's
+// directory, as those are named after an absolute path
+const archivesDir = "archives"
+
+// archiveFormat returns the format of an archive from its first bytes, empty if it isn't an archive
+func archiveFormat(archivePath string) (format string, err error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	start := make([]byte, len(ArchiveHeader))
+	n, _ := io.ReadFull(f, start)
+	start = start[:n]
+	switch {
+	case bytes.Equal(start, []byte(ArchiveHeader)):
+		return ArchiveGorun, nil
+	case bytes.HasPrefix(start, []byte{0x1f, 0x8b}):
+		return ArchiveTarGz, nil
+	case bytes.HasPrefix(start, []byte("PK\x03\x04")):
+		return ArchiveZip, nil
+	}
+	return "", nil
+}
+
+// IsArchive reports whether the file is an archive of a script (see OpenArchive) rather than a script
+func IsArchive(archivePath string) bool {
+	format, err := archiveFormat(archivePath)
+	return err == nil && format != ""
+}
+
+// OpenArchive returns the script in an archive made by Pack: a .gorun file, a gzipped tar or a zip. The archive is
+// unpacked once, in to a directory named after its checksum in the per user dir, and the script built from there like
+// any other. An archive without an ARCHIVE manifest must hold exactly one script at its top level
+func OpenArchive(archivePath string, opts Options) (s *Script, err error) {
+	format, err := archiveFormat(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find archive: %w", err)
+	} else if format == "" {
+		return nil, fmt.Errorf("%v isn't a gorun archive (.gorun, .tar.gz or .zip)", archivePath)
+	}
+	sum, err := fileHash(archivePath)
+	if err != nil {
+		return
+	}
+	tmpDirBase := opts.TmpDirBase
+	if tmpDirBase == "" {
+		tmpDirBase = DefaultTmpDirBase
+	}
+	perUserTmpDir, err := perUserTmpDirName()
+	if err != nil {
+		return
+	}
+	dir := filepath.Join(tmpDirBase, perUserTmpDir, archivesDir, hex.EncodeToString(sum[:16]))
+	root := filepath.Join(dir, "root")
+	if _, err = os.Stat(root); os.IsNotExist(err) {
+		err = unpackArchive(archivePath, format, dir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to unpack %v: %w", archivePath, err)
+	}
+	// clean removes unpacked archives that haven't been used for a while
+	_ = touchFile(filepath.Join(dir, ".lastRun"), false)
+
+	scriptRel, archiveRoot, err := archiveManifest(root)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", archivePath, err)
+	}
+	s, err = New(filepath.Join(root, filepath.FromSlash(scriptRel)), opts)
+	if err != nil {
+		return
+	}
+	s.name = archivePath
+	s.archiveRoot = archiveRoot
+	if archiveRoot != "" {
+		if s.unpackedRoot, err = realPath(root); err != nil {
+			return nil, err
+		}
+	}
+	s.log.Debug("running script from archive", "archive", archivePath, "script", s.scriptPath)
+	return
+}
+
+// archiveManifest reads the ARCHIVE manifest of an unpacked archive, or finds its only script if it has none
+func archiveManifest(root string) (scriptRel string, archiveRoot string, err error) {
+	content, err := os.ReadFile(filepath.Join(root, ARCHIVE))
+	if os.IsNotExist(err) {
+		return onlyScript(root)
+	} else if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		key, value, _ := strings.Cut(strings.TrimSpace(line), " ")
+		switch key {
+		case "script":
+			scriptRel = value
+		case "root":
+			archiveRoot = value
+		}
+	}
+	if !filepath.IsLocal(filepath.FromSlash(scriptRel)) {
+		return "", "", fmt.Errorf("%v: expected 'script <relative path>', got %q", ARCHIVE, scriptRel)
+	}
+	return
+}
+
+// onlyScript returns the one script at the top level of an unpacked archive without a manifest
+func onlyScript(root string) (scriptRel string, archiveRoot string, err error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+	var scripts []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && isScriptFile(filepath.Join(root, entry.Name())) {
+			scripts = append(scripts, entry.Name())
+		}
+	}
+	if len(scripts) != 1 {
+		return "", "", fmt.Errorf("no %v manifest, and %d scripts at the top level rather than one (use 'gorun pack')",
+			ARCHIVE, len(scripts))
+	}
+	return scripts[0], "", nil
+}
+
+// unpackArchive unpacks an archive in to dir/root. It is unpacked in to a temporary directory renamed in to place, so
+// a partly unpacked archive is never used, and any number of gorun processes can unpack the same archive at once
+func unpackArchive(archivePath string, format string, dir string) (err error) {
+	if err = os.MkdirAll(filepath.Dir(dir), 0700); err != nil {
+		return
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), filepath.Base(dir)+".")
+	if err != nil {
+		return
+	}
+	defer func() {
+		makeRemovable(tmp)
+		_ = os.RemoveAll(tmp) // gone if renamed in to place
+	}()
+	u := unpacker{root: filepath.Join(tmp, "root")}
+	if err = os.Mkdir(u.root, 0755); err != nil {
+		return
+	}
+	if format == ArchiveZip {
+		err = u.unzip(archivePath)
+	} else {
+		err = u.untar(archivePath, format)
+	}
+	if err == nil {
+		err = u.makeSymlinks()
+	}
+	if err != nil {
+		return
+	}
+	if err = os.Rename(tmp, dir); err != nil {
+		if _, statErr := os.Stat(filepath.Join(dir, "root")); statErr == nil {
+			return nil // unpacked by another gorun in the meantime
+		}
+	}
+	return
+}
+
+// unpacker writes the entries of an archive under root
+type unpacker struct {
+	root     string
+	symlinks [][2]string // made last, so no entry can be written through one
+}
+
+// target returns where an entry is written, refusing any that would be outside root
+func (u *unpacker) target(name string) (target string, err error) {
+	name = strings.TrimSuffix(name, "/")
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return "", fmt.Errorf("archive entry %q is outside the archive", name)
+	}
+	return filepath.Join(u.root, filepath.FromSlash(path.Clean(name))), nil
+}
+
+// entry writes one entry of the archive, a regular file's contents read from r
+func (u *unpacker) entry(name string, mode os.FileMode, linkname string, r io.Reader) (err error) {
+	target, err := u.target(name)
+	if err != nil {
+		return
+	}
+	switch {
+	case mode.IsDir():
+		// always writable, so the unpacked archive can be cleaned
+		return os.MkdirAll(target, 0755)
+	case mode&os.ModeSymlink != 0:
+		u.symlinks = append(u.symlinks, [2]string{linkname, target})
+		return nil
+	case !mode.IsRegular():
+		return fmt.Errorf("archive entry %q is not a regular file, directory or symlink", name)
+	}
+	if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode.Perm()|0600)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return
+}
+
+func (u *unpacker) makeSymlinks() (err error) {
+	for _, link := range u.symlinks {
+		// an earlier symlink could otherwise be a way out of root
+		for dir := filepath.Dir(link[1]); dir != u.root; dir = filepath.Dir(dir) {
+			if info, err := os.Lstat(dir); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				return fmt.Errorf("archive entry %q is through a symlink", link[1][len(u.root)+1:])
+			}
+		}
+		if err = os.MkdirAll(filepath.Dir(link[1]), 0755); err != nil {
+			return
+		}
+		if err = os.Symlink(link[0], link[1]); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (u *unpacker) untar(archivePath string, format string) (err error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	if format == ArchiveGorun {
+		if _, err = r.Discard(len(ArchiveHeader)); err != nil {
+			return
+		}
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		// the mode of a hard link is a regular file's, so it is refused by its type
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeDir, tar.TypeSymlink:
+		default:
+			return fmt.Errorf("archive entry %q is not a regular file, directory or symlink", hdr.Name)
+		}
+		if err = u.entry(hdr.Name, hdr.FileInfo().Mode(), hdr.Linkname, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func (u *unpacker) unzip(archivePath string) (err error) {
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return
+	}
+	defer zr.Close()
+	for _, file := range zr.File {
+		if err = u.unzipFile(file); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// unzipFile writes one file of a zip, whose symlinks hold their target as their contents
+func (u *unpacker) unzipFile(file *zip.File) (err error) {
+	r, err := file.Open()
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	var linkname string
+	if file.Mode()&os.ModeSymlink != 0 {
+		target, err := io.ReadAll(io.LimitReader(r, 4096))
+		if err != nil {
+			return err
+		}
+		linkname = string(target)
+	}
+	return u.entry(file.Name, file.Mode(), linkname, r)
+}
+
+// cleanArchives removes unpacked archives not used since cutoffTime, and any left part unpacked (e.g. by a crash)
+// before buildDirCutoffTime
+func cleanArchives(dir string, cutoffTime time.Time, buildDirCutoffTime time.Time) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		archiveDir := filepath.Join(dir, entry.Name())
+		if !entry.IsDir() {
+			continue
+		}
+		if strings.Contains(entry.Name(), ".") {
+			cleanBuildDir(archiveDir, buildDirCutoffTime)
+			continue
+		}
+		st, err := os.Stat(filepath.Join(archiveDir, ".lastRun"))
+		if err == nil && st.ModTime().Before(cutoffTime) {
+			makeRemovable(archiveDir)
+			_ = os.RemoveAll(archiveDir)
+		}
+	}
+	_ = os.Remove(dir)
+}
@@ -0,0 +1,163 @@
+package script
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnpackerTarget(t *testing.T) {
+	root := t.TempDir()
+	tests := []struct {
+		name string
+		want string // empty if refused
+	}{
+		{"hello.go", "hello.go"},
+		{"hello_/lib/lib.go", "hello_/lib/lib.go"},
+		{"hello_/", "hello_"},
+		{"./hello.go", "hello.go"},
+		{"./", "."},
+		{"a/../hello.go", "hello.go"},
+		{"../hello.go", ""},
+		{"a/../../hello.go", ""},
+		{"/etc/passwd", ""},
+		{"", ""},
+		{".", "."},
+		{"..", ""},
+	}
+	u := unpacker{root: root}
+	for _, tt := range tests {
+		got, err := u.target(tt.name)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("%q: got %v, want it refused", tt.name, got)
+		case tt.want != "" && err != nil:
+			t.Errorf("%q: %v", tt.name, err)
+		case tt.want != "" && got != filepath.Join(root, filepath.FromSlash(tt.want)):
+			t.Errorf("%q: got %v, want %v in %v", tt.name, got, tt.want, root)
+		}
+	}
+}
+
+// writeTarGz writes an archive of the entries, symlinks having a Linkname
+func writeTarGz(t *testing.T, path string, entries []tar.Header) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, hdr := range entries {
+		contents := ""
+		if hdr.Typeflag == tar.TypeReg {
+			contents = "contents of " + hdr.Name
+			hdr.Size = int64(len(contents))
+		}
+		hdr.Mode = 0644
+		if err = tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = tw.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnpackArchiveStaysInside(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tar.Header
+		wantErr string
+	}{{
+		name:    "parent directory",
+		entries: []tar.Header{{Name: "../escaped", Typeflag: tar.TypeReg}},
+		wantErr: "outside the archive",
+	}, {
+		name:    "absolute",
+		entries: []tar.Header{{Name: "/escaped", Typeflag: tar.TypeReg}},
+		wantErr: "outside the archive",
+	}, {
+		name: "written through a symlink",
+		entries: []tar.Header{
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE"},
+			{Name: "link/escaped", Typeflag: tar.TypeReg},
+		},
+		wantErr: "file exists",
+	}, {
+		name: "symlink made through a symlink",
+		entries: []tar.Header{
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE"},
+			{Name: "link/escaped", Typeflag: tar.TypeSymlink, Linkname: "anywhere"},
+		},
+		wantErr: "through a symlink",
+	}, {
+		name:    "device",
+		entries: []tar.Header{{Name: "dev", Typeflag: tar.TypeChar}},
+		wantErr: "not a regular file",
+	}, {
+		name: "hard link",
+		entries: []tar.Header{
+			{Name: "hello.go", Typeflag: tar.TypeReg},
+			{Name: "escaped", Typeflag: tar.TypeLink, Linkname: "OUTSIDE"},
+		},
+		wantErr: "not a regular file",
+	}, {
+		name:    "fifo",
+		entries: []tar.Header{{Name: "fifo", Typeflag: tar.TypeFifo}},
+		wantErr: "not a regular file",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			outside := filepath.Join(dir, "outside")
+			if err := os.Mkdir(outside, 0755); err != nil {
+				t.Fatal(err)
+			}
+			for i := range tt.entries {
+				tt.entries[i].Linkname = strings.ReplaceAll(tt.entries[i].Linkname, "OUTSIDE", outside)
+			}
+			archive := filepath.Join(dir, "escape.tar.gz")
+			writeTarGz(t, archive, tt.entries)
+			err := unpackArchive(archive, ArchiveTarGz, filepath.Join(dir, "archives", "x"))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got %v, want an error containing %q", err, tt.wantErr)
+			}
+			if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+				t.Errorf("wrote %v outside the archive", entries[0].Name())
+			}
+			if _, err = os.Lstat(filepath.Join(dir, "escaped")); err == nil {
+				t.Errorf("wrote escaped outside the archive")
+			}
+		})
+	}
+}
+
+func TestUnpackArchive(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "ok.tar.gz")
+	writeTarGz(t, archive, []tar.Header{
+		{Name: "hello_/", Typeflag: tar.TypeDir},
+		{Name: "hello_/lib/lib.go", Typeflag: tar.TypeReg},
+		{Name: "hello.go", Typeflag: tar.TypeReg},
+		{Name: "lib", Typeflag: tar.TypeSymlink, Linkname: "hello_/lib"},
+	})
+	archiveDir := filepath.Join(dir, "archives", "x")
+	if err := unpackArchive(archive, ArchiveTarGz, archiveDir); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(archiveDir, "root", "lib", "lib.go"))
+	if err != nil || string(got) != "contents of hello_/lib/lib.go" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
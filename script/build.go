@@ -0,0 +1,289 @@
+package script
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// writeFileFromCommentsOrDir uses either the parsed commented section (from the script or its bundle) or the file
+// on disc and writes it to the build tree, with any absolute paths pointed at their copies in the build tree
+func (s *Script) writeFileFromCommentsOrDir(tree *syncTree, sectionName string) (err error) {
+	content := s.section(sectionName)
+	if len(content) == 0 {
+		content, err = os.ReadFile(filepath.Join(filepath.Dir(s.scriptPath), sectionName))
+		if err != nil {
+			return nil // neither embedded nor on disc
+		}
+	}
+	content, err = s.rewriteAbsPaths(sectionName, content)
+	if err != nil {
+		return fmt.Errorf("failed to rewrite absolute paths in %v: %w", sectionName, err)
+	}
+	file := filepath.Join(s.buildTreeDir, sectionName)
+	err = tree.writeFile(file, content, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write %s to %s: %w", sectionName, file, err)
+	}
+	return
+}
+
+// lockBuildTree waits for any other process using the script's build tree, then locks it until unlock is called
+func (s *Script) lockBuildTree() (unlock func(), err error) {
+	err = os.MkdirAll(s.tmpDir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to mkdirAll for %v: %w", s.tmpDir, err)
+	}
+	unlock, err = lockFile(s.buildLock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock %v: %w", s.buildLock, err)
+	}
+	return
+}
+
+// updateTarget brings the build tree up to date with all the files needed to build the script binary. Only changed
+// files are rewritten, and files no longer needed (e.g. deleted from the extra source directory) are removed.
+// The build tree must be locked, see lockBuildTree
+func (s *Script) updateTarget() (err error) {
+	tree := newSyncTree(s.buildTreeBase, s.walker())
+	err = os.MkdirAll(s.buildTreeDir, 0700)
+	if err != nil {
+		return fmt.Errorf("failed to mkdirAll for %v: %w", s.buildTreeDir, err)
+	}
+
+	for _, dir := range s.sourceDirs() {
+		src := dir
+		dest := filepath.Join(s.buildTreeBase, dir)
+		s.log.Debug("syncing source directory", "src", src, "dest", dest)
+		err = tree.copyDir(dest, src)
+		if err != nil {
+			return fmt.Errorf("failed to copyDir: %w", err)
+		}
+	}
+
+	// The go script must be made to end in ".go" to allow go build to work with it
+	dstScriptPath := filepath.Join(s.buildTreeDir, filepath.Base(s.scriptPath))
+	if !strings.HasSuffix(s.scriptPath, ".go") {
+		dstScriptPath += ".go"
+	}
+
+	content := s.content
+	if len(content) > 2 && content[0] == '#' && content[1] == '!' {
+		content = append([]byte("//"), content[2:]...)
+	}
+	err = tree.writeFile(dstScriptPath, content, 0600)
+	if err != nil {
+		return
+	}
+
+	// Write the go.mod, go.sum, go.work and go.work.sum files from inside the comments
+	for _, name := range moduleFiles {
+		err = s.writeFileFromCommentsOrDir(tree, name)
+		if err != nil {
+			return
+		}
+	}
+
+	// Write any other declared files, e.g. for //go:embed
+	files, err := declaredFiles(s.content)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		err = s.writeDeclaredFile(tree, s.buildTreeDir, file.name)
+		if err != nil {
+			return
+		}
+	}
+
+	removed, err := tree.prune()
+	for _, path := range removed {
+		s.log.Debug("removed from build tree", "path", path)
+	}
+	return
+}
+
+// run a command sending all its output (stdout and stderr) to out. Not used to run the script
+func runCommand(dir string, env []string, out io.Writer, command string, args ...string) (err error) {
+	cmd := exec.Command(command, args...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.Dir = dir
+	cmd.Env = env
+	err = cmd.Run()
+	if err != nil {
+		err = fmt.Errorf("run command %v %v failed: %w", command, args, err)
+	}
+	return
+}
+
+// buildEnv returns the environment go build is run with, the caller's environment (only the allowed part of it for a
+// hermetic build, see hermeticEnv, without the go command's config file) plus the embedded go.env
+func (s *Script) buildEnv() (env []string) {
+	// use the default environment before adding our overrides, this allows GOPRIVATE etc. to be used in the build
+	env = os.Environ()
+	if s.hermetic {
+		env, _ = hermeticEnv(env)
+	}
+	section := s.section(GOENV)
+	if len(section) > 0 {
+		env = append(env, strings.Split(string(section), "\n")...)
+	}
+	if s.hermetic {
+		// nor the go command's own config file (written by 'go env -w', e.g. under HOME), which could set anything
+		env = append(env, "GOENV=off")
+	}
+	return
+}
+
+// getEnvVar returns the value of an environment variable from a slice of environment variables
+func getEnvVar(env []string, key string) string {
+
+	// Go through the list backwards so that we pick up the last version of any
+	// duplicate keys. This matches the behaviour of exec.Cmd.Env
+	for i := len(env) - 1; i >= 0; i-- {
+		line := env[i]
+		if strings.HasPrefix(line, key+"=") {
+			return strings.SplitAfterN(line, key+"=", 2)[1]
+		}
+	}
+	return ""
+}
+
+// compile updates the build tree with the script and its dependencies and compiles it there.
+// The build tree is kept, so the next compile only needs to copy what changed. It must be locked, see lockBuildTree
+func (s *Script) compile() (err error) {
+	err = s.updateTarget()
+	if err != nil {
+		return
+	}
+
+	env := s.goCommandEnv()
+	gobin, err := s.goBinary()
+	if err != nil {
+		return err
+	}
+
+	out := fmt.Sprintf("%v.%d", s.binary, os.Getpid())
+
+	s.log.Info("compiling script", "script", s.scriptPath, "dir", s.buildTreeDir, "go", gobin)
+	s.logDroppedEnv()
+	// paths in the output are mapped from the build tree back to the original files
+	var output bytes.Buffer
+	mapped := s.mapOutputPaths(io.MultiWriter(&output, s.buildOutput))
+	err = runCommand(s.buildTreeDir, env, mapped, gobin, "build", "-o", out, ".")
+	_ = mapped.Flush()
+	if err != nil {
+		_ = os.Remove(out)
+		return &BuildError{Output: output.Bytes(), Err: err}
+	}
+	return s.installBinary(out)
+}
+
+// transientFailure reports whether a failed compile may work next time without anything changing
+func transientFailure(buildErr *BuildError) bool {
+	return transientErrorRe.Match(buildErr.Output) || transientErrorRe.MatchString(buildErr.Error())
+}
+
+// installBinary moves a new binary in to place, keeping the one it replaces as a last known good fallback
+func (s *Script) installBinary(path string) (err error) {
+	_ = os.Remove(s.binaryPrev)
+	_ = os.Link(s.binary, s.binaryPrev)
+	return os.Rename(path, s.binary)
+}
+
+// failedBuildMaxAge is how long a failed compile is replayed for at most, in case it wasn't the script's fault after all
+const failedBuildMaxAge = time.Hour
+
+// transientErrorRe matches a compile failure that may go away by itself: a module that couldn't be downloaded, e.g.
+// as the proxy was unreachable, or the go command being killed
+var transientErrorRe = regexp.MustCompile(`dial tcp|i/o timeout|connection refused|connection reset|no such host|` +
+	`TLS handshake|unexpected EOF|Get "https?://|reading https?://|\b(429|5\d\d) [A-Z][a-z]|signal: `)
+
+// cachedFailure returns the BuildError of the last compile, replaying its output, if it failed with the same inputs
+// (see inputHash) within failedBuildMaxAge. Nothing is returned if Options.RetryFailed is set
+func (s *Script) cachedFailure(hash string) (err error) {
+	if s.retryFailed || hash == "" {
+		return nil
+	}
+	info, statErr := os.Stat(s.failedBuild)
+	if statErr != nil || time.Since(info.ModTime()) > failedBuildMaxAge {
+		return nil
+	}
+	content, readErr := os.ReadFile(s.failedBuild)
+	if readErr != nil {
+		return nil
+	}
+	failedHash, output, _ := bytes.Cut(content, []byte("\n"))
+	if string(failedHash) != hash {
+		return nil
+	}
+	s.log.Info("not compiling, the last compile of the same inputs failed", "script", s.scriptPath, "failed", s.failedBuild)
+	_, _ = s.buildOutput.Write(output)
+	return &BuildError{Output: output, Cached: true,
+		Err: fmt.Errorf("the last compile of %v failed and its inputs haven't changed since", s.scriptPath)}
+}
+
+// recordFailure keeps the output of a failed compile with the hash of its inputs, for cachedFailure, or removes any
+// earlier failure once a compile works. A failure that may go away by itself (see transientFailure), e.g. a module
+// proxy outage, isn't kept, so the script is compiled again next time. Nor is one without a hash, as nothing uses it
+func (s *Script) recordFailure(hash string, err error) {
+	var buildErr *BuildError
+	if err == nil || errors.As(err, &buildErr) && transientFailure(buildErr) {
+		_ = os.Remove(s.failedBuild)
+	} else if errors.As(err, &buildErr) && hash != "" {
+		content := append([]byte(hash+"\n"), buildErr.Output...)
+		if err = os.WriteFile(s.failedBuild, content, 0600); err != nil {
+			s.log.Warn("unable to record failed compile", "file", s.failedBuild, "err", err)
+		}
+	}
+}
+
+// goCommandEnv returns the environment to run the go command with in the build tree
+func (s *Script) goCommandEnv() (env []string) {
+	env = s.buildEnv()
+
+	// if $HOME/.cache can't be built and $GOCACHE is not set, then use a home dir alongside the binary
+	if getEnvVar(env, "GOCACHE") == "" {
+		home := getEnvVar(env, "HOME")
+		tmpHome := filepath.Join(s.tmpDir, "home")
+		if home == "" || home == "/" {
+			_ = os.MkdirAll(tmpHome, 0700)
+			env = append(env, "HOME="+tmpHome)
+		} else if _, err := os.Stat(filepath.Join(home, ".cache")); os.IsNotExist(err) {
+			err = os.Mkdir(filepath.Join(home, ".cache"), 0755)
+			if err != nil && !os.IsExist(err) {
+				// unable to create the .cache directory - give this process a temp home (env will likely contain HOME twice)
+				_ = os.MkdirAll(tmpHome, 0700)
+				env = append(env, "HOME="+tmpHome)
+			}
+		}
+	}
+	// custom directory for temporary files used during Go builds. Put it alongside the final binary so it can be auto-cleaned
+	env = append(env, "GOTMPDIR="+s.tmpDir)
+
+	if s.pinnedGoVersion != "" {
+		// stop the pinned toolchain from switching to (or downloading) another one
+		env = append(env, "GOTOOLCHAIN=local")
+	}
+	return
+}
+
+// makeRemovable allows a directory to be deleted.
+// os.RemoveAll mode 444 files (from go's module cache being here when no HOME dir set) on Unix don't allow unlink
+// so let's chmod all files/dirs to allow RemoveAll to work
+func makeRemovable(dir string) {
+	_ = filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err == nil {
+			err = os.Chmod(name, 0755)
+		}
+		return err
+	})
+}
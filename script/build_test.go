@@ -0,0 +1,79 @@
+package script
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTransientFailure(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		err    string
+		want   bool
+	}{
+		{"compile error", "./main.go:5:2: undefined: x\n", "exit status 1", false},
+		{"missing go.mod", "go: go.mod file not found in current directory or any parent directory\n", "exit status 1", false},
+		{"unknown module", "main.go:3:8: no required module provides package example.com/x\n", "exit status 1", false},
+		{"proxy unreachable", `main.go:3:8: example.com/x@v1.0.0: Get "https://proxy.golang.org/example.com/x/@v/v1.0.0.zip": dial tcp: lookup proxy.golang.org: no such host` + "\n", "exit status 1", true},
+		{"proxy error", "go: example.com/x@v1.0.0: reading https://proxy.example.com/example.com/x/@v/v1.0.0.mod: 503 Service Unavailable\n", "exit status 1", true},
+		{"timeout", "go: example.com/x@v1.0.0: i/o timeout\n", "exit status 1", true},
+		{"killed", "", "signal: killed", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buildErr := &BuildError{Output: []byte(tt.output), Err: errors.New(tt.err)}
+			if got := transientFailure(buildErr); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFailureCache(t *testing.T) {
+	needsGo(t)
+	path := filepath.Join(t.TempDir(), "hello.go")
+	writeScript(t, path, `fmt.Println(undefined)`, time.Now().Add(-time.Hour))
+	tests := []struct {
+		name        string
+		retryFailed bool
+		wantCached  bool
+		wantFailed  bool // .failed is kept
+	}{
+		{"retried, so not kept", true, false, false},
+		{"compiled and kept", false, false, true},
+		{"replayed", false, true, true},
+		{"retried", true, false, true},
+	}
+	opts := Options{TmpDirBase: t.TempDir()}
+	for _, tt := range tests {
+		opts.RetryFailed = tt.retryFailed
+		s, err := New(path, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.Command()
+		var buildErr *BuildError
+		if !errors.As(err, &buildErr) || buildErr.Cached != tt.wantCached {
+			t.Fatalf("%v: got %#v, want a BuildError cached %v", tt.name, err, tt.wantCached)
+		}
+		if _, err = os.Stat(s.failedBuild); (err == nil) != tt.wantFailed {
+			t.Errorf("%v: .failed kept: got %v, want %v", tt.name, err == nil, tt.wantFailed)
+		}
+	}
+
+	writeScript(t, path, `fmt.Println("fixed")`, time.Now().Add(-time.Hour))
+	s, err := New(path, Options{TmpDirBase: opts.TmpDirBase})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Command(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(s.failedBuild); err == nil {
+		t.Errorf(".failed kept after a compile that worked")
+	}
+}
@@ -0,0 +1,188 @@
+package script
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BUNDLE is the section a script uses to share its module files with other scripts in the same directory. It names
+// the bundle manifest, relative to the script's directory, DefaultBundle if the section is empty, e.g.
+//
+//	// gorun.bundle >>>
+//	// :gorun.mod
+//	// <<< gorun.bundle
+//
+// The bundle manifest holds the go.mod, go.sum, go.work, go.work.sum and go.env sections, in the same commented
+// format as a script, and these are used in place of any embedded in the script. -tidy, -get and -upgrade update the
+// bundle, taking the imports of every script using it in to account.
+const BUNDLE = "gorun.bundle"
+
+// DefaultBundle is the bundle manifest used by an empty gorun.bundle section
+const DefaultBundle = "gorun.mod"
+
+// bundleFiles are the sections taken from the bundle manifest, rather than the script
+var bundleFiles = append(append([]string{}, moduleFiles...), GOENV)
+
+// bundlePath returns the full path of the bundle manifest named by the script's gorun.bundle section, empty if
+// the script doesn't use a bundle
+func bundlePath(scriptPath string, content []byte) (path string, err error) {
+	section, found := findSection(content, BUNDLE)
+	if !found {
+		return "", nil
+	}
+	name := strings.TrimSpace(string(section.Content))
+	if name == "" {
+		name = DefaultBundle
+	}
+	if strings.Contains(name, "\n") {
+		return "", fmt.Errorf("section %q must name a single bundle manifest, not %q", BUNDLE, name)
+	}
+	if filepath.IsAbs(name) {
+		return filepath.Clean(name), nil
+	}
+	return filepath.Join(filepath.Dir(scriptPath), name), nil
+}
+
+// loadBundle reads and parses the bundle manifest used by the script, if any
+func (s *Script) loadBundle() (err error) {
+	s.bundlePath, err = bundlePath(s.scriptPath, s.content)
+	if err != nil || s.bundlePath == "" {
+		return
+	}
+	content, err := os.ReadFile(s.bundlePath)
+	if err != nil {
+		return fmt.Errorf("unable to read bundle manifest: %w", err)
+	}
+	s.bundleSections, err = ParseSections(content)
+	if err != nil {
+		return fmt.Errorf("malformed embedded sections in bundle manifest %v: %w", s.bundlePath, err)
+	}
+	return
+}
+
+// isBundleFile reports whether the section is taken from the bundle manifest when the script uses one
+func isBundleFile(sectionName string) bool {
+	for _, name := range bundleFiles {
+		if name == sectionName {
+			return true
+		}
+	}
+	return false
+}
+
+// bundleDiffs compares the module sections embedded in the script, then each of the other scripts using the bundle,
+// with those in the bundle manifest, reporting drift from any copies left in them
+func (s *Script) bundleDiffs() (diffs []SectionDiff, err error) {
+	bundle, err := os.ReadFile(s.bundlePath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read bundle manifest: %w", err)
+	}
+	others, err := s.bundleScripts()
+	if err != nil {
+		return
+	}
+	for _, script := range append([]string{s.scriptPath}, others...) {
+		content, err := os.ReadFile(script)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range moduleFiles {
+			section, inScript := findSection(content, name)
+			bundled, inBundle := findSection(bundle, name)
+			status := DiffBundleDrift
+			switch {
+			case !inScript && !inBundle:
+				status = DiffNeither
+			case !inScript:
+				status = DiffBundled
+			case inBundle && bytes.Equal(bytes.TrimSpace(section.Content), bytes.TrimSpace(bundled.Content)):
+				status = DiffBundleSame
+			}
+			diffs = append(diffs, SectionDiff{Script: script, Section: name, Status: status})
+		}
+	}
+	return
+}
+
+// bundleScripts returns the other scripts in the script's directory using the same bundle manifest
+func (s *Script) bundleScripts() (scripts []string, err error) {
+	dir := filepath.Dir(s.scriptPath)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if !entry.Type().IsRegular() || path == s.scriptPath || path == s.bundlePath || !isScriptFile(path) {
+			continue
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		other, err := bundlePath(path, content)
+		if err == nil && other == s.bundlePath {
+			scripts = append(scripts, path)
+		}
+	}
+	return
+}
+
+// isScriptFile reports whether a file looks like a script, a .go file or one starting with a gorun shebang or binfmt
+// line, so other executables in the same directory aren't read
+func isScriptFile(path string) bool {
+	if strings.HasSuffix(path, ".go") {
+		return true
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	start := make([]byte, 256)
+	n, _ := io.ReadFull(f, start)
+	start = start[:n]
+	line := start[:firstLineLen(start)]
+	if bytes.HasPrefix(start, []byte(ArchiveHeader)) {
+		return false // run by gorun, but not a script
+	}
+	return bytes.HasPrefix(line, []byte(BinfmtLine)) || (bytes.HasPrefix(line, []byte("#!")) && bytes.Contains(line, []byte("gorun")))
+}
+
+// updateBundleTarget adds the other scripts using the bundle, and their extra source directories, to the build
+// tree, so the go command sees all their imports. Each is placed in its own package main directory
+func (s *Script) updateBundleTarget() (err error) {
+	scripts, err := s.bundleScripts()
+	if err != nil {
+		return
+	}
+	// these are removed again by the next updateTarget
+	tree := newSyncTree(s.buildTreeBase, s.walker())
+	for _, script := range scripts {
+		content, err := os.ReadFile(script)
+		if err != nil {
+			return err
+		}
+		if bytes.HasPrefix(content, []byte("#!")) {
+			content[0], content[1] = '/', '/'
+		}
+		base := strings.TrimSuffix(filepath.Base(script), ".go")
+		dir := filepath.Join(s.buildTreeDir, "gorunbundle", base)
+		if err = tree.writeFile(filepath.Join(dir, base+".go"), content, 0600); err != nil {
+			return err
+		}
+		extraDir := filepath.Join(filepath.Dir(script), base+"_")
+		if info, err := os.Stat(extraDir); err == nil && info.IsDir() {
+			dest := filepath.Join(s.buildTreeBase, extraDir)
+			s.log.Debug("copying bundle script source directory", "src", extraDir, "dest", dest)
+			if err = tree.copyDir(dest, extraDir); err != nil {
+				return fmt.Errorf("failed to copyDir: %w", err)
+			}
+		}
+	}
+	return
+}
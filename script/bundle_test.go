@@ -0,0 +1,102 @@
+package script
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeBundleTree writes a bundle manifest in shared/, replacing the lib module with ./lib, and scripts in bin/ using
+// it, a.go importing lib and the others embedding their own go.mod
+func writeBundleTree(t *testing.T, root string) {
+	t.Helper()
+	bundleMod := "// :module tools\n// :\n// :go 1.24\n// :\n// :require lib v0.0.0\n// :\n// :replace lib => ./lib\n"
+	script := func(main string, imports string, gomod string) string {
+		return "// gorun.bundle >>>\n// :../shared/gorun.mod\n// <<< gorun.bundle\n" + gomod +
+			"package main\n\nimport (\n\t\"fmt\"\n" + imports + ")\n\nfunc main() {\n\tfmt.Println(" + main + ")\n}\n"
+	}
+	files := map[string]string{
+		"shared/gorun.mod":  "// go.mod >>>\n" + bundleMod + "// <<< go.mod\n",
+		"shared/lib/go.mod": "module lib\n\ngo 1.24\n",
+		"shared/lib/lib.go": "package lib\n\nfunc Hi() string { return \"hi\" }\n",
+		"bin/a.go":          script("lib.Hi()", "\n\t\"lib\"\n", ""),
+		"bin/b.go":          script(`"b"`, "", "// go.mod >>>\n// :module b\n// <<< go.mod\n"),
+		"bin/c.go":          script(`"c"`, "", "// go.mod >>>\n"+bundleMod+"// <<< go.mod\n"),
+	}
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBundleDiff(t *testing.T) {
+	root := t.TempDir()
+	writeBundleTree(t, root)
+	s, err := New(filepath.Join(root, "bin", "a.go"), Options{TmpDirBase: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := s.Diff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]DiffStatus{}
+	for _, diff := range diffs {
+		got[filepath.Base(diff.Script)+" "+diff.Section] = diff.Status
+	}
+	want := map[string]DiffStatus{}
+	for _, name := range moduleFiles {
+		for _, script := range []string{"a.go", "b.go", "c.go"} {
+			want[script+" "+name] = DiffNeither
+		}
+	}
+	want["a.go go.mod"] = DiffBundled
+	want["b.go go.mod"] = DiffBundleDrift
+	want["c.go go.mod"] = DiffBundleSame
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	if diffs[0].Script != s.Path() {
+		t.Errorf("got %v first, want the script itself", diffs[0].Script)
+	}
+}
+
+func TestBundleInAnotherDirectory(t *testing.T) {
+	needsGo(t)
+	root := t.TempDir()
+	writeBundleTree(t, root)
+	opts := Options{TmpDirBase: t.TempDir()}
+	s, err := New(filepath.Join(root, "bin", "a.go"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := s.Command()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := cmd.Output(); err != nil || string(out) != "hi\n" {
+		t.Fatalf("got %q, %v", out, err)
+	}
+	if want := []string{filepath.Join(root, "shared", "lib")}; !reflect.DeepEqual(s.sourceDirs(), want) {
+		t.Errorf("source directories: got %v, want %v relative to the bundle", s.sourceDirs(), want)
+	}
+
+	// the relative replace is kept when the bundle is tidied
+	if _, err = s.Tidy(); err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := os.ReadFile(filepath.Join(root, "shared", "gorun.mod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mod := string(GetSection(bundle, GOMOD)); !strings.Contains(mod, "replace lib => ./lib\n") {
+		t.Errorf("tidied go.mod lost the relative replace:\n%s", mod)
+	}
+}
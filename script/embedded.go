@@ -0,0 +1,382 @@
+package script
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+)
+
+// loadFile loads a file from disc, removing extra new lines and spaces
+func loadFile(filename string) (found bool, content []byte, err error) {
+	_, err = os.Stat(filename)
+	if err != nil {
+		return false, nil, nil // no error if file not there
+	}
+	content, err = os.ReadFile(filename)
+	if err != nil {
+		return // error if file there but can't be read
+	}
+	found = true
+	// get rid of extra new lines and whitespace
+	content = bytes.TrimSpace(content)
+	content = bytes.Replace(content, []byte("\n\n"), []byte("\n"), -1)
+	return
+}
+
+// DiffStatus is how an embedded section compares to the file on disc alongside the script
+type DiffStatus int
+
+const (
+	DiffNeither      DiffStatus = iota // neither embedded nor on disc
+	DiffSame                           // embedded and on disc are the same
+	DiffOnlyEmbedded                   // embedded, but not on disc
+	DiffOnlyOnDisc                     // on disc, but not embedded
+	DiffDifferent                      // embedded and on disc are different
+	DiffBundled                        // not embedded, taken from the bundle manifest
+	DiffBundleSame                     // embedded and the same as the bundle manifest
+	DiffBundleDrift                    // embedded and different to (or missing from) the bundle manifest
+)
+
+func (d DiffStatus) String() string {
+	switch d {
+	case DiffNeither:
+		return "not embedded or on disc"
+	case DiffSame:
+		return "embedded exists and same as on disc"
+	case DiffOnlyEmbedded:
+		return "embedded exists but nothing on disc"
+	case DiffOnlyOnDisc:
+		return "on disc exists but embedded doesn't"
+	case DiffDifferent:
+		return "embedded exists and different to on disc"
+	case DiffBundled:
+		return "taken from the bundle"
+	case DiffBundleSame:
+		return "embedded exists and same as the bundle, it can be removed"
+	case DiffBundleDrift:
+		return "embedded exists and has drifted from the bundle"
+	}
+	return "DiffStatus(" + strconv.Itoa(int(d)) + ")"
+}
+
+// SectionDiff is the result of comparing one embedded section with the file on disc, or the bundle manifest
+type SectionDiff struct {
+	Script  string // the script the section is embedded in
+	Section string
+	Status  DiffStatus
+}
+
+// InSync is true if there is nothing to embed or extract for this section
+func (d SectionDiff) InSync() bool {
+	return d.Status == DiffNeither || d.Status == DiffSame || d.Status == DiffBundled || d.Status == DiffBundleSame
+}
+
+func diffBytes(content []byte, dir string, sectionName string) (diff DiffStatus, err error) {
+	section := GetSection(content, sectionName)
+	section = bytes.TrimSpace(section)
+	section = bytes.Replace(section, []byte("\n\n"), []byte("\n"), -1)
+
+	foundOnDisc, sectionFromFile, err := loadFile(filepath.Join(dir, sectionName))
+	if err != nil { // file exists but unable to read
+		return
+	}
+	if !foundOnDisc && len(section) == 0 {
+		return DiffNeither, nil
+	}
+	if !foundOnDisc {
+		return DiffOnlyEmbedded, nil
+	}
+	if len(section) == 0 && len(sectionFromFile) > 0 {
+		return DiffOnlyOnDisc, nil
+	}
+	if bytes.Equal(sectionFromFile, section) {
+		return DiffSame, nil
+	}
+	return DiffDifferent, nil
+}
+
+// Diff compares the embedded go.mod/go.sum/go.work/go.work.sum sections, and any files declared in the gorun.files
+// section, with the files on disc alongside the script. If the script uses a bundle, the module sections of every
+// script using it are compared with the bundle manifest instead
+func (s *Script) Diff() (diffs []SectionDiff, err error) {
+	content, err := os.ReadFile(s.scriptPath)
+	if err != nil {
+		return
+	}
+	s.bundlePath, err = bundlePath(s.scriptPath, content)
+	if err != nil {
+		return
+	}
+	if s.bundlePath != "" {
+		diffs, err = s.bundleDiffs()
+		if err != nil {
+			return
+		}
+	}
+	for _, sectionName := range moduleFiles {
+		if s.bundlePath != "" {
+			break
+		}
+		var status DiffStatus
+		status, err = diffBytes(content, filepath.Dir(s.scriptPath), sectionName)
+		if err != nil {
+			return
+		}
+		diffs = append(diffs, SectionDiff{Script: s.scriptPath, Section: sectionName, Status: status})
+	}
+	files, err := declaredFiles(content)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		name := file.name
+		section, found := findSection(content, name)
+		foundOnDisc, fileContent, err := loadDeclaredFile(filepath.Join(filepath.Dir(s.scriptPath), filepath.FromSlash(name)))
+		if err != nil {
+			return diffs, err
+		}
+		status := DiffDifferent
+		switch {
+		case !found && !foundOnDisc:
+			status = DiffNeither
+		case !foundOnDisc:
+			status = DiffOnlyEmbedded
+		case !found:
+			status = DiffOnlyOnDisc
+		case sameContent(section, fileContent):
+			status = DiffSame
+		}
+		diffs = append(diffs, SectionDiff{Script: s.scriptPath, Section: name, Status: status})
+	}
+	return
+}
+
+// Extract writes the embedded go.mod/go.sum/go.work/go.work.sum sections, and any files declared in the
+// gorun.files section, to files alongside the script
+func (s *Script) Extract() (err error) {
+	content, err := os.ReadFile(s.scriptPath)
+	if err != nil {
+		return
+	}
+	_, err = writeFileFromComments(content, GOSUM, filepath.Join(filepath.Dir(s.scriptPath), GOSUM))
+
+	if err != nil {
+		return
+	}
+	_, err = writeFileFromComments(content, GOMOD, filepath.Join(filepath.Dir(s.scriptPath), GOMOD))
+	if err != nil {
+		return
+	}
+	if len(GetSection(content, GOWORK)) != 0 {
+		_, err = writeFileFromComments(content, GOWORK, filepath.Join(filepath.Dir(s.scriptPath), GOWORK))
+		if err != nil {
+			return
+		}
+	}
+	if len(GetSection(content, GOWORKSUM)) != 0 {
+		_, err = writeFileFromComments(content, GOWORKSUM, filepath.Join(filepath.Dir(s.scriptPath), GOWORKSUM))
+		if err != nil {
+			return
+		}
+	}
+	files, err := declaredFiles(content)
+	if err != nil {
+		return
+	}
+	for _, declared := range files {
+		file := filepath.Join(filepath.Dir(s.scriptPath), filepath.FromSlash(declared.name))
+		if len(GetSection(content, declared.name)) == 0 {
+			continue
+		}
+		if err = os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			return
+		}
+		if _, err = writeFileFromComments(content, declared.name, file); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// ExtractIfMissing extracts the files go.sum, go.mod from the comments at the top of the script and put on disc
+// ONLY if they both don't already exist on disc.
+func (s *Script) ExtractIfMissing() (err error) {
+	foundSumOnDisc, _, err := loadFile(filepath.Join(filepath.Dir(s.scriptPath), GOSUM))
+	if err != nil {
+		return
+	}
+	foundModOnDisc, _, err := loadFile(filepath.Join(filepath.Dir(s.scriptPath), GOMOD))
+	if err != nil {
+		return
+	}
+	foundWorkOnDisc, _, err := loadFile(filepath.Join(filepath.Dir(s.scriptPath), GOWORK))
+	if err != nil {
+		return
+	}
+	foundWorkSumOnDisc, _, err := loadFile(filepath.Join(filepath.Dir(s.scriptPath), GOWORKSUM))
+	if err != nil {
+		return
+	}
+
+	if !foundModOnDisc && !foundSumOnDisc && !foundWorkOnDisc && !foundWorkSumOnDisc {
+		err = s.Extract()
+	}
+	return
+}
+
+// Embed embeds the files go.sum, go.mod in the comments at the top of the script (go.work is optional)
+func (s *Script) Embed() (err error) {
+	content, err := os.ReadFile(s.scriptPath)
+	if err != nil {
+		return
+	}
+	if _, err = ParseSections(content); err != nil {
+		return fmt.Errorf("not embedding in to malformed sections, see gorun -check: %w", err)
+	}
+	content, err = embedModuleFiles(content, filepath.Dir(s.scriptPath))
+	if err != nil {
+		return
+	}
+
+	// any declared files go after the module files and the manifest, in the order declared
+	files, err := declaredFiles(content)
+	if err != nil {
+		return
+	}
+	previous := append(append([]string{}, moduleFiles...), FILES)
+	for _, file := range files {
+		foundOnDisc, fileContent, err := loadDeclaredFile(filepath.Join(filepath.Dir(s.scriptPath), filepath.FromSlash(file.name)))
+		if err != nil {
+			return err
+		}
+		if foundOnDisc {
+			existing, found := findSection(content, file.name)
+			encoding := embedEncoding(file, existing, found, fileContent)
+			if encoding == "" {
+				fileContent = bytes.TrimSuffix(fileContent, []byte("\n"))
+			}
+			_, content, err = EmbedEncodedSection(content, fileContent, file.name, encoding, previous)
+			if err != nil {
+				return err
+			}
+		}
+		previous = append(previous, file.name)
+	}
+
+	err = os.WriteFile(s.scriptPath, content, 0600)
+	return
+}
+
+// embedModuleFiles embeds the go.mod, go.sum, go.work and go.work.sum files found in dir in to content
+func embedModuleFiles(content []byte, dir string) (newContent []byte, err error) {
+	foundSumOnDisc, sumContent, err := loadFile(filepath.Join(dir, GOSUM))
+	if err != nil {
+		return
+	}
+	foundModOnDisc, modContent, err := loadFile(filepath.Join(dir, GOMOD))
+	if err != nil {
+		return
+	}
+	foundWorkOnDisc, workContent, _ := loadFile(filepath.Join(dir, GOWORK))
+	foundWorkSumOnDisc, workSumContent, _ := loadFile(filepath.Join(dir, GOWORKSUM))
+
+	// let's only delete an embedded section if there is a section file (e.g. go.sum) on disc alongside
+	if foundModOnDisc {
+		_, content = EmbedSection(content, modContent, GOMOD, []string{})
+	}
+
+	if foundSumOnDisc {
+		_, content = EmbedSection(content, sumContent, GOSUM, []string{GOMOD})
+	}
+
+	if foundWorkOnDisc {
+		_, content = EmbedSection(content, workContent, GOWORK, []string{GOMOD, GOSUM})
+	}
+
+	if foundWorkSumOnDisc {
+		_, content = EmbedSection(content, workSumContent, GOWORKSUM, []string{GOMOD, GOSUM, GOWORK})
+	}
+	return content, nil
+}
+
+// writeFileFromComments write out a particular commented section of a goscript file to a file
+func writeFileFromComments(content []byte, sectionName string, file string) (written bool, err error) {
+	// Write a go.mod file from inside the comments
+	section := GetSection(content, sectionName)
+	if len(section) > 0 {
+		err = os.WriteFile(file, section, 0600)
+		if err != nil {
+			return false, fmt.Errorf("failed to write %s to %s: %w", sectionName, file, err)
+		}
+		written = true
+	}
+	return
+}
+
+// Check validates the embedded sections of the script, returning every problem found (joined *ParseError).
+// As well as the section markers, the contents of go.mod, go.sum, go.work, go.work.sum and go.env are checked.
+// Comments that look like loose section markers are returned too, as warnings (see ParseError.Warning)
+func (s *Script) Check() (err error) {
+	content, err := os.ReadFile(s.scriptPath)
+	if err != nil {
+		return
+	}
+	sections, err := ParseSections(content)
+	errs := append([]error{err}, looseMarkers(content, sections)...)
+	for _, section := range sections {
+		errs = append(errs, validateSection(section)...)
+	}
+	if _, found := findSection(content, FILES); found {
+		if _, err = declaredFiles(content); err != nil {
+			section, _ := findSection(content, FILES)
+			errs = append(errs, &ParseError{Line: section.StartLine, Msg: err.Error()})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateSection checks the contents of the well known sections can be parsed
+func validateSection(section Section) (errs []error) {
+	// content starts on the line after the header
+	fail := func(line int, format string, args ...any) {
+		errs = append(errs, &ParseError{Line: section.StartLine + line, Msg: section.Name + ": " + fmt.Sprintf(format, args...)})
+	}
+	modfileErrs := func(err error) {
+		var errList modfile.ErrorList
+		if errors.As(err, &errList) {
+			for _, e := range errList {
+				fail(e.Pos.Line, "%v", e.Err)
+			}
+		} else if err != nil {
+			fail(0, "%v", err)
+		}
+	}
+
+	switch section.Name {
+	case GOMOD:
+		_, err := modfile.Parse(GOMOD, section.Content, nil)
+		modfileErrs(err)
+	case GOWORK:
+		_, err := modfile.ParseWork(GOWORK, section.Content, nil)
+		modfileErrs(err)
+	case GOSUM, GOWORKSUM:
+		for i, line := range strings.Split(string(section.Content), "\n") {
+			if line != "" && len(strings.Fields(line)) != 3 {
+				fail(i+1, "expected 'module version hash', got %q", line)
+			}
+		}
+	case GOENV:
+		for i, line := range strings.Split(string(section.Content), "\n") {
+			if key, _, ok := strings.Cut(line, "="); line != "" && (!ok || key == "") {
+				fail(i+1, "expected KEY=value, got %q", line)
+			}
+		}
+	}
+	return
+}
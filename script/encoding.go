@@ -0,0 +1,91 @@
+package script
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// Section encodings, given after the header marker, e.g. '// assets.tar.gz >>> base64'. Sections without an
+// encoding hold text, one line per comment line.
+const (
+	EncodingBase64     = "base64"      // the file is base64 encoded, for binary files
+	EncodingGzipBase64 = "gzip+base64" // the file is gzip compressed then base64 encoded, for larger files
+)
+
+// base64LineLen is the length of the base64 encoded lines, as used by MIME
+const base64LineLen = 76
+
+// validEncoding reports whether encoding is empty (text) or one gorun can decode
+func validEncoding(encoding string) bool {
+	return encoding == "" || encoding == EncodingBase64 || encoding == EncodingGzipBase64
+}
+
+// encodeSection returns the lines of a section holding content in the given encoding
+func encodeSection(content []byte, encoding string) (lines []string, err error) {
+	switch encoding {
+	case "":
+		return strings.Split(string(content), "\n"), nil
+	case EncodingGzipBase64:
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		if _, err = zw.Write(content); err != nil {
+			return
+		}
+		if err = zw.Close(); err != nil {
+			return
+		}
+		content = compressed.Bytes()
+		fallthrough
+	case EncodingBase64:
+		encoded := base64.StdEncoding.EncodeToString(content)
+		for len(encoded) > base64LineLen {
+			lines = append(lines, encoded[:base64LineLen])
+			encoded = encoded[base64LineLen:]
+		}
+		return append(lines, encoded), nil
+	}
+	return nil, fmt.Errorf("unknown section encoding %q", encoding)
+}
+
+// decodeSection returns the contents of a section from its (uncommented) lines
+func decodeSection(lines []string, encoding string) (content []byte, err error) {
+	switch encoding {
+	case "":
+		var buf bytes.Buffer
+		for _, line := range lines {
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+		}
+		return buf.Bytes(), nil
+	case EncodingBase64, EncodingGzipBase64:
+		content, err = base64.StdEncoding.DecodeString(strings.Join(lines, ""))
+		if err != nil || encoding == EncodingBase64 {
+			return
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(zr)
+	}
+	return nil, fmt.Errorf("unknown section encoding %q", encoding)
+}
+
+// textRoundTrips reports whether content survives being embedded as a text section unchanged (other than a trailing
+// newline). Anything else (binary files, carriage returns, trailing whitespace) needs base64 encoded
+func textRoundTrips(content []byte) bool {
+	if !utf8.Valid(content) || bytes.ContainsAny(content, "\x00\r") {
+		return false
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.TrimRight(line, " \t") != line {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package script
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeSectionRoundTrips(t *testing.T) {
+	long := bytes.Repeat([]byte{0, 1, 2, 0xff}, 100)
+	tests := []struct {
+		name     string
+		content  string
+		encoding string
+		want     string // the decoded content, if not the same
+	}{
+		{"text", "a\n\tb", "", "a\n\tb\n"}, // text sections always end in a newline
+		{"binary", "\x00\x01\x02\xff", EncodingBase64, ""},
+		{"empty", "", EncodingBase64, ""},
+		{"multiple lines", string(long), EncodingBase64, ""},
+		{"compressed", string(long), EncodingGzipBase64, ""},
+		{"compressed empty", "", EncodingGzipBase64, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines, err := encodeSection([]byte(tt.content), tt.encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range lines {
+				if tt.encoding != "" && len(line) > base64LineLen {
+					t.Errorf("line of %v characters, want at most %v", len(line), base64LineLen)
+				}
+			}
+			got, err := decodeSection(lines, tt.encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.want
+			if want == "" {
+				want = tt.content
+			}
+			if string(got) != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestDecodeSectionErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		lines    []string
+		encoding string
+	}{
+		{"not base64", []string{"not base64!"}, EncodingBase64},
+		{"not gzip", []string{"AAEC"}, EncodingGzipBase64},
+		{"unknown encoding", []string{"AAEC"}, "hex"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := decodeSection(tt.lines, tt.encoding); err == nil {
+				t.Errorf("got %q, want an error", got)
+			}
+		})
+	}
+	if _, err := encodeSection(nil, "hex"); err == nil {
+		t.Errorf("encoded with an unknown encoding")
+	}
+}
+
+func TestTextRoundTrips(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    bool
+	}{
+		{"text", "a\n\tb\n", true},
+		{"no final newline", "a", true},
+		{"trailing space", "a \nb\n", false},
+		{"trailing tab", "a\t", false},
+		{"carriage return", "a\r\nb\r\n", false},
+		{"nul", "a\x00b", false},
+		{"invalid utf-8", "a\xffb", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := textRoundTrips([]byte(tt.content)); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
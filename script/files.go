@@ -0,0 +1,125 @@
+package script
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FILES is the manifest section listing any other files embedded in the script, one path per line relative to
+// the script's directory, e.g.
+//
+//	// gorun.files >>>
+//	// :config.yaml
+//	// :testdata/input.json
+//	// <<< gorun.files
+//
+// Each declared file is then embedded as its own section (e.g. '// config.yaml >>>'), written alongside the
+// script in the build directory so it can be used with //go:embed, and handled by -embed, -extract and -diff.
+const FILES = "gorun.files"
+
+// moduleFiles are the go module files always handled, in the order they are placed in the script
+var moduleFiles = []string{GOMOD, GOSUM, GOWORK, GOWORKSUM}
+
+// declaredFile is a file listed in the gorun.files manifest section, optionally followed by the encoding to embed
+// it with, e.g. 'assets.tar.gz base64'
+type declaredFile struct {
+	name     string
+	encoding string
+}
+
+// declaredFiles returns the files listed in the gorun.files manifest section. Blank lines and lines starting with
+// '#' are ignored
+func declaredFiles(content []byte) (files []declaredFile, err error) {
+	manifest := GetSection(content, FILES)
+	for _, line := range strings.Split(string(manifest), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("%s: expected 'file [encoding]', got %q", FILES, line)
+		}
+		file := declaredFile{name: fields[0]}
+		if len(fields) == 2 {
+			file.encoding = fields[1]
+		}
+		if err = validDeclaredFile(file.name); err != nil {
+			return nil, err
+		}
+		if !validEncoding(file.encoding) {
+			return nil, fmt.Errorf("%s: %q has unknown encoding %q, expected %s or %s",
+				FILES, file.name, file.encoding, EncodingBase64, EncodingGzipBase64)
+		}
+		files = append(files, file)
+	}
+	return
+}
+
+// validDeclaredFile checks a file from the manifest stays within the script's directory, and isn't a file gorun
+// already manages
+func validDeclaredFile(name string) error {
+	if path.IsAbs(name) || path.Clean(name) != name || name == ".." || strings.HasPrefix(name, "../") {
+		return fmt.Errorf("%s: %q must be a clean path relative to the script's directory", FILES, name)
+	}
+	if name == FILES || name == GOENV {
+		return fmt.Errorf("%s: %q can't be declared as a file", FILES, name)
+	}
+	for _, moduleFile := range moduleFiles {
+		if name == moduleFile {
+			return fmt.Errorf("%s: %q is always handled, it doesn't need declared", FILES, name)
+		}
+	}
+	return nil
+}
+
+// loadDeclaredFile loads a declared file from disc as is
+func loadDeclaredFile(filename string) (found bool, content []byte, err error) {
+	content, err = os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return false, nil, nil
+	}
+	return err == nil, content, err
+}
+
+// embedEncoding returns how to embed a declared file: as declared in the manifest, else as it is already embedded,
+// else as text if it survives that unchanged, otherwise base64
+func embedEncoding(file declaredFile, existing Section, found bool, content []byte) string {
+	if file.encoding != "" {
+		return file.encoding
+	}
+	if found {
+		return existing.Encoding
+	}
+	if textRoundTrips(content) {
+		return ""
+	}
+	return EncodingBase64
+}
+
+// sameContent compares a declared file with its embedded section. Text sections always end in a newline, so a
+// missing one on disc isn't a difference
+func sameContent(section Section, fileContent []byte) bool {
+	if section.Encoding != "" {
+		return bytes.Equal(section.Content, fileContent)
+	}
+	return bytes.Equal(bytes.TrimSuffix(section.Content, []byte("\n")), bytes.TrimSuffix(fileContent, []byte("\n")))
+}
+
+// writeDeclaredFile writes a declared file from its section to dir in the build tree (creating any subdirectories),
+// falling back to a copy of the file on disc alongside the script if it isn't embedded
+func (s *Script) writeDeclaredFile(tree *syncTree, dir string, name string) (err error) {
+	// sections decode to the exact file contents, whatever the encoding
+	file := filepath.Join(dir, filepath.FromSlash(name))
+	if section, found := findSection(s.content, name); found {
+		return tree.writeFile(file, section.Content, 0600)
+	}
+	content, err := os.ReadFile(filepath.Join(filepath.Dir(s.scriptPath), filepath.FromSlash(name)))
+	if err != nil {
+		return fmt.Errorf("declared file %q is not embedded or on disc alongside the script: %w", name, err)
+	}
+	return tree.writeFile(file, content, 0600)
+}
@@ -0,0 +1,98 @@
+package script
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDeclaredFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		want     []declaredFile
+		wantErr  string
+	}{
+		{"none", "", nil, ""},
+		{"files", "config.yaml\ntestdata/input.json", []declaredFile{{name: "config.yaml"}, {name: "testdata/input.json"}}, ""},
+		{"blank lines and comments", "\n# the config\nconfig.yaml\n  \n", []declaredFile{{name: "config.yaml"}}, ""},
+		{"encodings", "logo.png base64\nassets.tar gzip+base64", []declaredFile{{"logo.png", EncodingBase64}, {"assets.tar", EncodingGzipBase64}}, ""},
+		{"unknown encoding", "logo.png hex", nil, `"logo.png" has unknown encoding "hex"`},
+		{"too many fields", "logo.png base64 extra", nil, "expected 'file [encoding]'"},
+		{"absolute", "/etc/passwd", nil, "must be a clean path"},
+		{"parent directory", "../config.yaml", nil, "must be a clean path"},
+		{"unclean", "testdata/../config.yaml", nil, "must be a clean path"},
+		{"module file", "go.mod", nil, "always handled"},
+		{"the manifest", FILES, nil, "can't be declared"},
+		{"go.env", GOENV, nil, "can't be declared"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var content strings.Builder
+			content.WriteString("package main\n\n// " + FILES + " >>>\n")
+			for _, line := range strings.Split(tt.manifest, "\n") {
+				content.WriteString("// :" + line + "\n")
+			}
+			content.WriteString("// <<< " + FILES + "\n")
+			got, err := declaredFiles([]byte(content.String()))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSameContent(t *testing.T) {
+	tests := []struct {
+		name     string
+		section  Section
+		file     string
+		wantSame bool
+	}{
+		{"text", Section{Content: []byte("a\nb\n")}, "a\nb\n", true},
+		{"text without a final newline on disc", Section{Content: []byte("a\nb\n")}, "a\nb", true},
+		{"text differs", Section{Content: []byte("a\nb\n")}, "a\nc\n", false},
+		{"encoded", Section{Content: []byte("a\x00"), Encoding: EncodingBase64}, "a\x00", true},
+		{"encoded newline matters", Section{Content: []byte("a\x00"), Encoding: EncodingBase64}, "a\x00\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sameContent(tt.section, []byte(tt.file)); got != tt.wantSame {
+				t.Errorf("got %v, want %v", got, tt.wantSame)
+			}
+		})
+	}
+}
+
+func TestEmbedEncoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     declaredFile
+		existing Section
+		found    bool
+		content  string
+		want     string
+	}{
+		{"declared", declaredFile{"a.txt", EncodingGzipBase64}, Section{Encoding: EncodingBase64}, true, "text\n", EncodingGzipBase64},
+		{"as already embedded", declaredFile{name: "a.bin"}, Section{Encoding: EncodingBase64}, true, "text\n", EncodingBase64},
+		{"already embedded as text", declaredFile{name: "a.bin"}, Section{}, true, "\x00", ""},
+		{"new text", declaredFile{name: "a.txt"}, Section{}, false, "text\n", ""},
+		{"new binary", declaredFile{name: "a.bin"}, Section{}, false, "\x00\x01", EncodingBase64},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := embedEncoding(tt.file, tt.existing, tt.found, []byte(tt.content)); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package script
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// hashIgnoredEnv are go settings that don't change what is built, so are left out of the input hash
+var hashIgnoredEnv = map[string]bool{
+	"GOCACHE": true, "GOENV": true, "GOMODCACHE": true, "GOPATH": true, "GOTELEMETRY": true, "GOTELEMETRYDIR": true,
+	"GOTMPDIR": true,
+}
+
+// inputHash returns a hash of everything the binary is compiled from: the toolchain/platform variant, the script
+// and its bundle manifest, every file in the source directories, the module and declared files (embedded or
+// alongside the script) and the go environment. The same inputs give the same binary, or the same compile error.
+// Paths are relative to the directory holding them all, so the same script and directories give the same hash wherever
+// they are, e.g. on each host that unpacked an archive
+func (s *Script) inputHash() (hash string, err error) {
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "variant %v\n", filepath.Base(s.tmpDir))
+	root := commonDir(append([]string{s.scriptPath, s.bundlePath}, s.sourceDirs()...))
+	err = s.walkInputs(func(path string, info os.FileInfo) error {
+		name := path
+		if rel, err := filepath.Rel(root, path); err == nil {
+			name = filepath.ToSlash(rel)
+		}
+		switch {
+		case info.IsDir():
+			_, _ = fmt.Fprintf(h, "dir %v\n", name)
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintf(h, "symlink %v %v\n", name, target)
+		default:
+			sum, err := fileHash(path)
+			if err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintf(h, "file %v %v %x\n", name, info.Mode().Perm(), sum)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	for _, name := range moduleFiles {
+		content, err := s.moduleFile(name)
+		if err != nil {
+			return "", err
+		}
+		_, _ = fmt.Fprintf(h, "module %v %x\n", name, sha256.Sum256(content))
+	}
+	files, err := declaredFiles(s.content)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		// as writeDeclaredFile finds it, a missing file fails the build so hashes as empty
+		var content []byte
+		if section, found := findSection(s.content, file.name); found {
+			content = section.Content
+		} else {
+			content, _ = os.ReadFile(filepath.Join(filepath.Dir(s.scriptPath), filepath.FromSlash(file.name)))
+		}
+		_, _ = fmt.Fprintf(h, "declared %v %x\n", file.name, sha256.Sum256(content))
+	}
+	// the go command's own settings, e.g. GOFLAGS or GOPRIVATE, can make or break a build. Where it keeps its files
+	// doesn't, and differs between users sharing binaries through a remote cache
+	var env []string
+	for _, kv := range s.buildEnv() {
+		name, _, _ := strings.Cut(kv, "=")
+		if (strings.HasPrefix(name, "GO") || strings.HasPrefix(name, "CGO_")) && !hashIgnoredEnv[name] {
+			env = append(env, kv)
+		}
+	}
+	sort.Strings(env)
+	for _, kv := range env {
+		_, _ = fmt.Fprintf(h, "env %v\n", kv)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// commonDir returns the deepest directory holding all the (non empty) paths
+func commonDir(paths []string) (dir string) {
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if dir == "" {
+			dir = filepath.Dir(path)
+		}
+		for {
+			if rel, err := filepath.Rel(dir, path); err == nil && filepath.IsLocal(rel) {
+				break
+			}
+			parent := filepath.Dir(dir)
+			if parent == dir {
+				return dir
+			}
+			dir = parent
+		}
+	}
+	return
+}
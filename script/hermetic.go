@@ -0,0 +1,71 @@
+package script
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"sort"
+	"strings"
+)
+
+// hermeticAllowed are the caller's environment variables kept for a hermetic build. They say who is building and
+// where the go command keeps its files (see hashIgnoredEnv) or how it reaches the network (including the CA
+// certificates trusted, e.g. behind a corporate proxy, and where modules are fetched from, e.g. a corporate module
+// proxy or private modules), not what is built, as go.sum pins the modules' contents. So they are left out of the
+// cache key too. Anything else, e.g. GOFLAGS, CGO_ENABLED or GOOS, must come from go.env
+var hermeticAllowed = map[string]bool{
+	"PATH": true, "HOME": true, "USER": true, "LOGNAME": true, "TMPDIR": true,
+	"HTTP_PROXY": true, "HTTPS_PROXY": true, "NO_PROXY": true, "http_proxy": true, "https_proxy": true, "no_proxy": true,
+	"SSH_AUTH_SOCK": true, "SSL_CERT_FILE": true, "SSL_CERT_DIR": true,
+	"GOPROXY": true, "GOPRIVATE": true, "GONOPROXY": true, "GONOSUMDB": true, "GONOSUMCHECK": true, "GOINSECURE": true,
+	"GOSUMDB": true, "GOAUTH": true,
+	// needed by the go command on windows
+	"SYSTEMROOT": true, "TEMP": true, "TMP": true, "USERPROFILE": true, "LOCALAPPDATA": true, "APPDATA": true,
+}
+
+// hermeticEnv returns the allowed entries of environ (see hermeticAllowed), and the names of those dropped. GOENV is
+// always dropped, see buildEnv
+func hermeticEnv(environ []string) (env []string, dropped []string) {
+	for _, kv := range environ {
+		name, _, _ := strings.Cut(kv, "=")
+		if name != "GOENV" && (hermeticAllowed[name] || hashIgnoredEnv[name]) {
+			env = append(env, kv)
+		} else {
+			dropped = append(dropped, name)
+		}
+	}
+	sort.Strings(dropped)
+	return
+}
+
+// hermeticEnvKey summarises the effective build environment of a hermetic build (in practice the embedded go.env),
+// for the cache variant, so a change to it never reuses a binary built without it
+func hermeticEnvKey(env []string) string {
+	effective := map[string]string{}
+	for _, kv := range env {
+		name, value, _ := strings.Cut(kv, "=")
+		if !hermeticAllowed[name] && !hashIgnoredEnv[name] {
+			effective[name] = value // the last one wins, as for exec.Cmd
+		}
+	}
+	names := make([]string, 0, len(effective))
+	for name := range effective {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		_, _ = h.Write([]byte(name + "=" + effective[name] + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// logDroppedEnv reports, at debug, the caller's environment variables left out of a hermetic build
+func (s *Script) logDroppedEnv() {
+	if !s.hermetic {
+		return
+	}
+	_, dropped := hermeticEnv(os.Environ())
+	s.log.Debug("hermetic build, dropped the caller's environment variables", "script", s.scriptPath,
+		"dropped", strings.Join(dropped, ","))
+}
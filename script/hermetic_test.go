@@ -0,0 +1,50 @@
+package script
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHermeticEnv(t *testing.T) {
+	environ := []string{
+		"PATH=/bin", "HOME=/home/a", "GOFLAGS=-tags=x", "GOPROXY=https://proxy.corp", "GOPRIVATE=git.corp/*",
+		"GOENV=/home/a/.config/go/env", "GOCACHE=/home/a/.cache/go-build", "CGO_ENABLED=1", "SSL_CERT_FILE=/etc/ca.pem",
+		"GOOS=windows", "EDITOR=vi",
+	}
+	env, dropped := hermeticEnv(environ)
+	wantEnv := []string{
+		"PATH=/bin", "HOME=/home/a", "GOPROXY=https://proxy.corp", "GOPRIVATE=git.corp/*",
+		"GOCACHE=/home/a/.cache/go-build", "SSL_CERT_FILE=/etc/ca.pem",
+	}
+	if !reflect.DeepEqual(env, wantEnv) {
+		t.Errorf("env: got %q, want %q", env, wantEnv)
+	}
+	if want := []string{"CGO_ENABLED", "EDITOR", "GOENV", "GOFLAGS", "GOOS"}; !reflect.DeepEqual(dropped, want) {
+		t.Errorf("dropped: got %q, want %q", dropped, want)
+	}
+}
+
+func TestHermeticEnvKey(t *testing.T) {
+	key := hermeticEnvKey([]string{"PATH=/bin", "CGO_ENABLED=0", "GOFLAGS=-trimpath"})
+	tests := []struct {
+		name    string
+		env     []string
+		sameKey bool
+	}{
+		{"the same", []string{"PATH=/bin", "CGO_ENABLED=0", "GOFLAGS=-trimpath"}, true},
+		{"another order", []string{"GOFLAGS=-trimpath", "CGO_ENABLED=0", "PATH=/bin"}, true},
+		{"allowed variables differ", []string{"PATH=/usr/bin", "HOME=/home/b", "GOPROXY=direct", "GOCACHE=/c", "CGO_ENABLED=0", "GOFLAGS=-trimpath"}, true},
+		{"the last one wins", []string{"CGO_ENABLED=1", "CGO_ENABLED=0", "GOFLAGS=-trimpath"}, true},
+		{"a value differs", []string{"PATH=/bin", "CGO_ENABLED=1", "GOFLAGS=-trimpath"}, false},
+		{"one is missing", []string{"PATH=/bin", "CGO_ENABLED=0"}, false},
+		{"one more", []string{"PATH=/bin", "CGO_ENABLED=0", "GOFLAGS=-trimpath", "GOAMD64=v3"}, false},
+		{"empty is still set", []string{"PATH=/bin", "CGO_ENABLED=0", "GOFLAGS=-trimpath", "GOARM="}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hermeticEnvKey(tt.env); (got == key) != tt.sameKey {
+				t.Errorf("got %v against %v, want the same key %v", got, key, tt.sameKey)
+			}
+		})
+	}
+}
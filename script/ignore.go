@@ -0,0 +1,136 @@
+package script
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// IGNORE is the file, in the extra source directory or a go.work library, listing files to leave out of the build
+// and change detection, in gitignore syntax, e.g.
+//
+//	.git/
+//	*.swp
+//	/testdata/large/
+//	!testdata/large/keep.json
+const IGNORE = ".gorunignore"
+
+// ignorePattern is one line of a .gorunignore file
+type ignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool // '!' re-includes what an earlier pattern excluded
+	dirOnly bool // a trailing '/' only matches directories
+}
+
+// ignoreRules are the patterns of a .gorunignore file, matched against paths relative to its directory
+type ignoreRules []ignorePattern
+
+// loadIgnoreRules reads the .gorunignore file in dir, no rules if there isn't one
+func loadIgnoreRules(dir string) (rules ignoreRules, err error) {
+	file := filepath.Join(dir, IGNORE)
+	content, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		pattern, ok, err := parseIgnorePattern(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%v:%d: %w", file, lineNum, err)
+		}
+		if ok {
+			rules = append(rules, pattern)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// parseIgnorePattern turns a gitignore style line in to a pattern, ok is false for blank lines and comments
+func parseIgnorePattern(line string) (pattern ignorePattern, ok bool, err error) {
+	// trailing spaces are ignored unless escaped with a backslash
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return pattern, false, nil
+	}
+	if strings.HasPrefix(line, "!") {
+		pattern.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// a pattern with a slash (other than a trailing one) is relative to the .gorunignore directory, otherwise it
+	// matches at any depth
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return pattern, false, nil
+	}
+
+	var re strings.Builder
+	re.WriteString("^")
+	if !anchored {
+		re.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case strings.HasPrefix(line[i:], "**/") && (i == 0 || line[i-1] == '/'):
+			re.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(line[i:], "**") && i+2 == len(line) && (i == 0 || line[i-1] == '/'):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '\\' && i+1 < len(line):
+			i++
+			re.WriteString(regexp.QuoteMeta(line[i : i+1]))
+		case c == '[':
+			end := strings.IndexByte(line[i+1:], ']')
+			if end < 0 {
+				return pattern, false, fmt.Errorf("unterminated [ in %q", line)
+			}
+			class := line[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	pattern.re, err = regexp.Compile(re.String())
+	if err != nil {
+		return pattern, false, fmt.Errorf("invalid pattern %q: %w", line, err)
+	}
+	return pattern, true, nil
+}
+
+// ignored reports whether a path (relative to the .gorunignore directory, '/' separated) is excluded. The last
+// matching pattern wins, so a later '!' pattern can re-include a file
+func (rules ignoreRules) ignored(relPath string, isDir bool) (ignored bool) {
+	for _, pattern := range rules {
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+		if pattern.re.MatchString(relPath) {
+			ignored = !pattern.negate
+		}
+	}
+	return
+}
@@ -0,0 +1,122 @@
+package script
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// ignoreRulesOf parses the lines of a .gorunignore file
+func ignoreRulesOf(t *testing.T, lines ...string) (rules ignoreRules) {
+	t.Helper()
+	for _, line := range lines {
+		pattern, ok, err := parseIgnorePattern(line)
+		if err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		if ok {
+			rules = append(rules, pattern)
+		}
+	}
+	return
+}
+
+func TestIgnored(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []string
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"no rules", nil, "a.go", false, false},
+		{"blank lines and comments", []string{"", "   ", "# a.go"}, "a.go", false, false},
+		{"name", []string{"a.go"}, "a.go", false, true},
+		{"name at any depth", []string{"a.go"}, "x/y/a.go", false, true},
+		{"name is the whole element", []string{"a.go"}, "xa.go", false, false},
+		{"star", []string{"*.swp"}, "x/.a.go.swp", false, true},
+		{"star doesn't cross a slash", []string{"x*.go"}, "x/a.go", false, false},
+		{"question mark", []string{"?.go"}, "a.go", false, true},
+		{"question mark is one character", []string{"?.go"}, "ab.go", false, false},
+		{"class", []string{"[ab].go"}, "b.go", false, true},
+		{"negated class", []string{"[!ab].go"}, "b.go", false, false},
+		{"directory only, a directory", []string{".git/"}, ".git", true, true},
+		{"directory only, a file", []string{".git/"}, ".git", false, false},
+		{"leading slash is anchored", []string{"/a.go"}, "x/a.go", false, false},
+		{"leading slash at the root", []string{"/a.go"}, "a.go", false, true},
+		{"inner slash is anchored", []string{"testdata/large"}, "x/testdata/large", true, false},
+		{"inner slash at the root", []string{"testdata/large"}, "testdata/large", true, true},
+		{"leading double star", []string{"**/large"}, "x/y/large", false, true},
+		{"inner double star", []string{"a/**/b"}, "a/b", false, true},
+		{"inner double star, deeper", []string{"a/**/b"}, "a/x/y/b", false, true},
+		{"trailing double star", []string{"a/**"}, "a/x/y", false, true},
+		{"trailing double star, not the directory", []string{"a/**"}, "a", true, false},
+		{"negated", []string{"*.json", "!keep.json"}, "keep.json", false, false},
+		{"negated, others still ignored", []string{"*.json", "!keep.json"}, "other.json", false, true},
+		{"last match wins", []string{"!keep.json", "*.json"}, "keep.json", false, true},
+		{"escaped bang", []string{`\!a.go`}, "!a.go", false, true},
+		{"escaped hash", []string{`\#a.go`}, "#a.go", false, true},
+		{"escaped star", []string{`a\*.go`}, "ab.go", false, false},
+		{"trailing spaces dropped", []string{"a.go   "}, "a.go", false, true},
+		{"escaped trailing space kept", []string{`a.go\ `}, "a.go ", false, true},
+		{"dots are literal", []string{"a.go"}, "a_go", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ignoreRulesOf(t, tt.rules...).ignored(tt.path, tt.isDir); got != tt.ignored {
+				t.Errorf("%q with %q: got %v, want %v", tt.path, tt.rules, got, tt.ignored)
+			}
+		})
+	}
+}
+
+func TestLoadIgnoreRules(t *testing.T) {
+	dir := t.TempDir()
+	if rules, err := loadIgnoreRules(dir); rules != nil || err != nil {
+		t.Errorf("no file: got %v, %v", rules, err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, IGNORE), []byte("# comment\n*.swp\nbad[\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := loadIgnoreRules(dir)
+	if want := IGNORE + ":3: unterminated ["; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("got %v, want an error containing %q", err, want)
+	}
+}
+
+func TestWalkIgnores(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{
+		IGNORE, "main.go", "main.go.swp", ".git/config", "testdata/large/big.json", "testdata/large/keep.json",
+		"testdata/small.json", "sub/main.go.swp",
+	} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		content := ""
+		if name == IGNORE {
+			content = ".git/\n*.swp\n/testdata/large/*\n!/testdata/large/keep.json\n"
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []string
+	err := walker{symlinks: SymlinksRecreate, scriptDir: root}.walk(root, func(path string, info os.FileInfo) error {
+		if !info.IsDir() {
+			rel, _ := filepath.Rel(root, path)
+			got = append(got, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{IGNORE, "main.go", "testdata/large/keep.json", "testdata/small.json"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
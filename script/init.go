@@ -0,0 +1,129 @@
+package script
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+)
+
+// How a new script is made executable by Init
+const (
+	FirstLineNone    = ""        // a plain go file, run with 'gorun name.go'
+	FirstLineShebang = "shebang" // '#!/usr/bin/env gorun'
+	FirstLineBinfmt  = "binfmt"  // '///bin/env gorun', see gorun-register.sh
+)
+
+// shebangLine is the first line of a script made executable with a shebang
+const shebangLine = "#!/usr/bin/env gorun"
+
+// InitOptions configures the script written by Init
+type InitOptions struct {
+	Module    string // module name for the embedded go.mod, the script's base name if empty
+	FirstLine string // FirstLineNone, FirstLineShebang or FirstLineBinfmt
+	ExtraDir  bool   // also create the extra source directory (the script name with a trailing '_') with a package in it
+}
+
+const scriptTemplate = `package main
+
+import (
+	"flag"
+	"fmt"
+%[1]s)
+
+func main() {
+	flag.Parse()
+	fmt.Println(%[2]s)
+}
+`
+
+const extraDirTemplate = `// Package extra holds source files too large to keep in the script itself
+package extra
+
+// Greeting is used by the script's main
+func Greeting() string {
+	return "Hello world!"
+}
+`
+
+var goVersionRe = regexp.MustCompile(`^go(\d+\.\d+(?:\.\d+)?)`)
+
+// Init writes a new compilable script to scriptPath with a go.mod embedded for the installed go toolchain. It refuses
+// to overwrite an existing file
+func Init(scriptPath string, opts InitOptions) (err error) {
+	if _, err = os.Stat(scriptPath); err == nil {
+		return fmt.Errorf("not overwriting existing %v", scriptPath)
+	}
+	base := strings.TrimSuffix(filepath.Base(scriptPath), ".go")
+	if opts.Module == "" {
+		opts.Module = base
+	}
+
+	version, err := (&Script{}).toolchainVersion()
+	if err != nil {
+		return
+	}
+	match := goVersionRe.FindStringSubmatch(version)
+	if match == nil {
+		return fmt.Errorf("unable to use toolchain version %q for the go directive", version)
+	}
+	mf := &modfile.File{}
+	if err = mf.AddModuleStmt(opts.Module); err != nil {
+		return
+	}
+	if err = mf.AddGoStmt(match[1]); err != nil {
+		return
+	}
+	gomod, err := mf.Format()
+	if err != nil {
+		return
+	}
+
+	imports, greeting := "", `"Hello world!"`
+	if opts.ExtraDir {
+		imports = fmt.Sprintf("\n\textra %q\n", opts.Module+"/"+base+"_")
+		greeting = "extra.Greeting()"
+	}
+	content := []byte(fmt.Sprintf(scriptTemplate, imports, greeting))
+	switch opts.FirstLine {
+	case FirstLineNone:
+	case FirstLineShebang:
+		content = append([]byte(shebangLine+"\n"), content...)
+	case FirstLineBinfmt:
+		content = append([]byte(BinfmtLine+"\n"), content...)
+	default:
+		return fmt.Errorf("unknown first line %q, must be %q or %q", opts.FirstLine, FirstLineShebang, FirstLineBinfmt)
+	}
+	// blank lines are collapsed, the same as when embedding a go.mod from disc
+	gomod = bytes.ReplaceAll(bytes.TrimSpace(gomod), []byte("\n\n"), []byte("\n"))
+	_, content = EmbedSection(content, gomod, GOMOD, []string{})
+	content = addBlankLineAfterSection(content, GOMOD)
+
+	mode := os.FileMode(0644)
+	if opts.FirstLine != FirstLineNone {
+		mode = 0755
+	}
+	if opts.ExtraDir {
+		extraDir := filepath.Join(filepath.Dir(scriptPath), base+"_")
+		if err = os.MkdirAll(extraDir, 0755); err != nil {
+			return
+		}
+		if err = os.WriteFile(filepath.Join(extraDir, "extra.go"), []byte(extraDirTemplate), 0644); err != nil {
+			return
+		}
+	}
+	return os.WriteFile(scriptPath, content, mode)
+}
+
+// addBlankLineAfterSection separates a newly embedded section from the code after it, so gofmt leaves it alone
+func addBlankLineAfterSection(content []byte, sectionName string) []byte {
+	found, _, _, _, endIdx := SectionIndexes(content, sectionName)
+	if !found || endIdx >= len(content) || content[endIdx] == '\n' {
+		return content
+	}
+	return append(append(append([]byte{}, content[:endIdx]...), '\n'), content[endIdx:]...)
+}
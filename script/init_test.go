@@ -0,0 +1,104 @@
+package script
+
+import (
+	"go/format"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestInit(t *testing.T) {
+	needsGo(t)
+	tests := []struct {
+		name       string
+		opts       InitOptions
+		wantFirst  string
+		wantModule string
+		wantMode   os.FileMode
+	}{
+		{"plain", InitOptions{}, "// go.mod >>>", "hello", 0644},
+		{"module", InitOptions{Module: "example.com/hello"}, "// go.mod >>>", "example.com/hello", 0644},
+		{"shebang", InitOptions{FirstLine: FirstLineShebang}, shebangLine, "hello", 0755},
+		{"binfmt", InitOptions{FirstLine: FirstLineBinfmt}, BinfmtLine, "hello", 0755},
+		{"extra directory", InitOptions{ExtraDir: true}, "// go.mod >>>", "hello", 0644},
+		{"extra directory of a module", InitOptions{Module: "example.com/hello", ExtraDir: true}, "// go.mod >>>", "example.com/hello", 0644},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "hello.go")
+			if err := Init(path, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			content, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first, _, _ := strings.Cut(string(content), "\n"); first != tt.wantFirst {
+				t.Errorf("first line %q, want %q", first, tt.wantFirst)
+			}
+			if mod := string(GetSection(content, GOMOD)); !strings.HasPrefix(mod, "module "+tt.wantModule+"\ngo ") {
+				t.Errorf("got go.mod:\n%s", mod)
+			}
+			if info, err := os.Stat(path); err == nil && runtime.GOOS != "windows" && info.Mode().Perm() != tt.wantMode {
+				t.Errorf("mode %v, want %v", info.Mode().Perm(), tt.wantMode)
+			}
+			if _, err := os.Stat(filepath.Join(filepath.Dir(path), "hello_", "extra.go")); (err == nil) != tt.opts.ExtraDir {
+				t.Errorf("extra directory: %v, want it created %v", err, tt.opts.ExtraDir)
+			}
+			// gofmt leaves it as it is, other than a first line that isn't go
+			code := content
+			if tt.opts.FirstLine != FirstLineNone {
+				code = content[len(tt.wantFirst)+1:]
+			}
+			if formatted, err := format.Source(code); err != nil || string(formatted) != string(code) {
+				t.Errorf("gofmt changes it (%v):\n%s", err, formatted)
+			}
+
+			s, err := New(path, Options{TmpDirBase: t.TempDir()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			cmd, err := s.Command()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out, err := cmd.Output(); err != nil || string(out) != "Hello world!\n" {
+				t.Errorf("got %q, %v", out, err)
+			}
+		})
+	}
+}
+
+func TestInitRefuses(t *testing.T) {
+	needsGo(t)
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing.go")
+	if err := os.WriteFile(existing, []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		path    string
+		opts    InitOptions
+		wantErr string
+	}{
+		{"existing file", existing, InitOptions{}, "not overwriting"},
+		{"unknown first line", filepath.Join(dir, "new.go"), InitOptions{FirstLine: "bang"}, "unknown first line"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Init(tt.path, tt.opts)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+	if content, _ := os.ReadFile(existing); string(content) != "package main\n" {
+		t.Errorf("overwrote the existing file with %q", content)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new.go")); err == nil {
+		t.Errorf("wrote a script despite the error")
+	}
+}
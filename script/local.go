@@ -0,0 +1,217 @@
+package script
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/mod/modfile"
+)
+
+// moduleFile returns a module file used to build the script, embedded (or from its bundle) or alongside the script
+// on disc, empty if neither
+func (s *Script) moduleFile(name string) (content []byte, err error) {
+	content = s.section(name)
+	if len(content) == 0 {
+		content, err = os.ReadFile(filepath.Join(filepath.Dir(s.scriptPath), name))
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	return
+}
+
+// moduleFileDir returns the directory relative paths in a module file are relative to: the bundle manifest's, if the
+// file is taken from the bundle, otherwise the script's
+func (s *Script) moduleFileDir(name string) string {
+	if s.bundlePath != "" && len(s.section(name)) > 0 {
+		return filepath.Dir(s.bundlePath)
+	}
+	return filepath.Dir(s.scriptPath)
+}
+
+// localDirs returns the full paths of the local directories the script's go.work 'use' and go.work/go.mod 'replace'
+// directives refer to, relative (e.g. ../lib or ./sub, to the file's directory, see moduleFileDir) or absolute. These
+// are copied in to the build tree and checked for changes. The script's own directory (e.g. 'use .') isn't included,
+// as it is the script's module
+func (s *Script) localDirs() (dirs []string, err error) {
+	seen := map[string]bool{filepath.Dir(s.scriptPath): true}
+	add := func(dir string, path string) {
+		if filepath.IsAbs(path) {
+			path = s.localPath(path)
+		} else {
+			path = filepath.Join(dir, path)
+		}
+		path = filepath.Clean(path)
+		if !seen[path] && path != dir {
+			seen[path] = true
+			dirs = append(dirs, path)
+		}
+	}
+
+	gowork, err := s.moduleFile(GOWORK)
+	if err != nil {
+		return
+	}
+	wf, err := modfile.ParseWork(GOWORK, gowork, nil)
+	if err != nil {
+		return
+	}
+	dir := s.moduleFileDir(GOWORK)
+	for _, use := range wf.Use {
+		add(dir, use.Path)
+	}
+	for _, replace := range wf.Replace {
+		if modfile.IsDirectoryPath(replace.New.Path) {
+			add(dir, replace.New.Path)
+		}
+	}
+
+	gomod, err := s.moduleFile(GOMOD)
+	if err != nil || len(gomod) == 0 {
+		return
+	}
+	mf, err := modfile.Parse(GOMOD, gomod, nil)
+	if err != nil {
+		return
+	}
+	dir = s.moduleFileDir(GOMOD)
+	for _, replace := range mf.Replace {
+		if modfile.IsDirectoryPath(replace.New.Path) {
+			add(dir, replace.New.Path)
+		}
+	}
+	return
+}
+
+// buildPath returns where an absolute path outside the build tree is copied to within it
+func (s *Script) buildPath(path string) string {
+	return filepath.Join(s.buildTreeBase, path)
+}
+
+// localPath returns where an absolute path from a go.mod or go.work is on this host. For a script run from an archive,
+// paths under the directory it was packed from are where they were unpacked to, otherwise it is the path itself
+func (s *Script) localPath(path string) string {
+	if s.archiveRoot == "" {
+		return path
+	}
+	rel, err := filepath.Rel(s.archiveRoot, filepath.Clean(path))
+	if err != nil || !filepath.IsLocal(rel) && rel != "." {
+		return path
+	}
+	return filepath.Join(s.unpackedRoot, rel)
+}
+
+// rewriteAbsPaths points any absolute directory paths in a go.mod or go.work being written to the build tree at
+// their copies in the build tree, so the copies (not the originals) are built. Relative paths already resolve to the
+// copies, as the build tree mirrors the script's absolute path, unless the file is from a bundle manifest in another
+// directory, so they are pointed at their copies too. Other files are returned as they are
+func (s *Script) rewriteAbsPaths(name string, content []byte) (rewritten []byte, err error) {
+	dir := s.moduleFileDir(name)
+	fromBundle := dir != filepath.Dir(s.scriptPath)
+	// treePath returns where a directory path in the file is copied to in the build tree, ok is false if it already
+	// resolves there
+	treePath := func(path string) (rewritten string, ok bool) {
+		switch {
+		case filepath.IsAbs(path):
+			return s.buildPath(s.localPath(path)), true
+		case fromBundle && filepath.Join(dir, path) != dir:
+			return s.buildPath(filepath.Join(dir, path)), true
+		}
+		return path, false
+	}
+	var formatted []byte
+	switch name {
+	case GOWORK:
+		wf, err := modfile.ParseWork(name, content, nil)
+		if err != nil {
+			return nil, err
+		}
+		changed := false
+		for _, use := range append([]*modfile.Use{}, wf.Use...) {
+			if path, ok := treePath(use.Path); ok {
+				changed = true
+				modulePath := use.ModulePath
+				if err = wf.DropUse(use.Path); err != nil {
+					return nil, err
+				}
+				if err = wf.AddUse(path, modulePath); err != nil {
+					return nil, err
+				}
+			}
+		}
+		for _, replace := range append([]*modfile.Replace{}, wf.Replace...) {
+			if path, ok := treePath(replace.New.Path); ok && modfile.IsDirectoryPath(replace.New.Path) {
+				changed = true
+				if err = wf.AddReplace(replace.Old.Path, replace.Old.Version, path, ""); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if !changed {
+			return content, nil
+		}
+		wf.Cleanup()
+		formatted = modfile.Format(wf.Syntax)
+	case GOMOD:
+		mf, err := modfile.Parse(name, content, nil)
+		if err != nil {
+			return nil, err
+		}
+		changed := false
+		for _, replace := range append([]*modfile.Replace{}, mf.Replace...) {
+			if path, ok := treePath(replace.New.Path); ok && modfile.IsDirectoryPath(replace.New.Path) {
+				changed = true
+				if err = mf.AddReplace(replace.Old.Path, replace.Old.Version, path, ""); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if !changed {
+			return content, nil
+		}
+		mf.Cleanup()
+		formatted, err = mf.Format()
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return content, nil
+	}
+	s.log.Debug("pointed absolute paths at the build tree", "file", name)
+	return formatted, nil
+}
+
+// restoreBundlePaths points the relative replace directories of a bundle manifest in another directory, that
+// rewriteAbsPaths pointed at the build tree, back at the relative paths in a go.mod written by the go command
+func (s *Script) restoreBundlePaths(modContent []byte) (restored []byte, err error) {
+	dir := s.moduleFileDir(GOMOD)
+	if dir == filepath.Dir(s.scriptPath) {
+		return modContent, nil
+	}
+	original, err := modfile.Parse(GOMOD, s.section(GOMOD), nil)
+	if err != nil {
+		return
+	}
+	relative := map[string]string{}
+	for _, replace := range original.Replace {
+		if path := replace.New.Path; modfile.IsDirectoryPath(path) && !filepath.IsAbs(path) {
+			relative[s.buildPath(filepath.Join(dir, path))] = path
+		}
+	}
+	if len(relative) == 0 {
+		return modContent, nil
+	}
+	mf, err := modfile.Parse(GOMOD, modContent, nil)
+	if err != nil {
+		return
+	}
+	for _, replace := range append([]*modfile.Replace{}, mf.Replace...) {
+		if path, found := relative[replace.New.Path]; found {
+			if err = mf.AddReplace(replace.Old.Path, replace.Old.Version, path, ""); err != nil {
+				return
+			}
+		}
+	}
+	mf.Cleanup()
+	return mf.Format()
+}
@@ -0,0 +1,103 @@
+package script
+
+import (
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// localScript returns a script at ROOT/home/hello.go with the given go.mod and go.work embedded, ROOT replaced by
+// root, as if packed from ROOT/packed and unpacked to ROOT/unpacked if archived is set
+func localScript(root string, gomod string, gowork string, archived bool) *Script {
+	s := &Script{
+		scriptPath:    filepath.Join(root, "home", "hello.go"),
+		buildTreeBase: filepath.Join(root, "tree"),
+		log:           slog.New(slog.DiscardHandler),
+	}
+	for name, content := range map[string]string{GOMOD: gomod, GOWORK: gowork} {
+		if content != "" {
+			s.sections = append(s.sections, Section{Name: name, Content: []byte(strings.ReplaceAll(content, "ROOT", root))})
+		}
+	}
+	if archived {
+		s.archiveRoot, s.unpackedRoot = filepath.Join(root, "packed"), filepath.Join(root, "unpacked")
+	}
+	return s
+}
+
+func TestLocalDirs(t *testing.T) {
+	root := t.TempDir()
+	tests := []struct {
+		name     string
+		gomod    string
+		gowork   string
+		archived bool
+		want     []string // relative to root
+	}{
+		{"none", "module hello\n", "", false, nil},
+		{"relative replace", "module hello\nreplace lib => ../lib\nreplace sub => ./sub\n", "", false, []string{"lib", "home/sub"}},
+		{"absolute replace", "module hello\nreplace lib => ROOT/abs/lib\n", "", false, []string{"abs/lib"}},
+		{"module replace", "module hello\nreplace lib => example.com/lib v1.0.0\n", "", false, nil},
+		{"the script's own directory", "module hello\nreplace self => ./\n", "", false, nil},
+		{"go.work", "", "go 1.24\nuse .\nuse ../a\nuse ROOT/b\nreplace c => ../c\n", false, []string{"a", "b", "c"}},
+		{"go.work and go.mod, once each", "module hello\nreplace a => ../a\nreplace d => ../d\n", "go 1.24\nuse (\n\t.\n\t../a\n)\n", false, []string{"a", "d"}},
+		{"archived", "module hello\nreplace lib => ROOT/packed/lib\nreplace other => ROOT/other\nreplace rel => ../rel\n", "", true, []string{"unpacked/lib", "other", "rel"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := localScript(root, tt.gomod, tt.gowork, tt.archived).localDirs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []string
+			for _, dir := range tt.want {
+				want = append(want, filepath.Join(root, filepath.FromSlash(dir)))
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRewriteAbsPaths(t *testing.T) {
+	root := t.TempDir()
+	tree := filepath.Join(root, "tree")
+	tests := []struct {
+		name     string
+		file     string
+		content  string
+		archived bool
+		want     string // contained in the rewritten file, TREE being the build tree copy of ROOT, empty if unchanged
+	}{
+		{"relative go.mod replace", GOMOD, "module hello\nreplace lib => ../lib\n", false, ""},
+		{"module replace", GOMOD, "module hello\nreplace lib => example.com/lib v1.0.0\n", false, ""},
+		{"absolute go.mod replace", GOMOD, "module hello\nreplace lib => ROOT/lib\n", false, "replace lib => TREE/lib\n"},
+		{"absolute go.work use", GOWORK, "go 1.24\nuse .\nuse ROOT/lib\n", false, "\tTREE/lib\n"},
+		{"absolute go.work replace", GOWORK, "go 1.24\nuse .\nreplace lib => ROOT/lib\n", false, "replace lib => TREE/lib\n"},
+		{"relative go.work use", GOWORK, "go 1.24\nuse .\nuse ../lib\n", false, ""},
+		{"archived", GOMOD, "module hello\nreplace lib => ROOT/packed/lib\n", true, "replace lib => TREE/unpacked/lib\n"},
+		{"other files", GOSUM, "lib v1.0.0 ROOT/lib\n", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := localScript(root, "", "", tt.archived)
+			content := []byte(strings.ReplaceAll(tt.content, "ROOT", root))
+			got, err := s.rewriteAbsPaths(tt.file, content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == "" {
+				if string(got) != string(content) {
+					t.Errorf("got %q, want it unchanged", got)
+				}
+				return
+			}
+			if want := strings.ReplaceAll(tt.want, "TREE", filepath.Join(tree, root)); !strings.Contains(string(got), want) {
+				t.Errorf("got:\n%s\nwant it to contain %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !windows && !plan9
+
+package script
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on path (creating it if needed), waiting for any other process holding it
+func lockFile(path string) (unlock func(), err error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return
+	}
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
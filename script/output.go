@@ -0,0 +1,100 @@
+package script
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// originalPath returns the file a path in the build tree was copied from, the inverse of buildPath. ok is false for
+// paths outside the build tree
+func (s *Script) originalPath(treePath string) (path string, ok bool) {
+	rel, err := filepath.Rel(s.buildTreeBase, treePath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	path = string(filepath.Separator) + rel
+	scriptDir := filepath.Dir(s.scriptPath)
+	switch {
+	case path == s.scriptPath+".go" && !strings.HasSuffix(s.scriptPath, ".go"):
+		// the script is copied with a .go suffix added if it hasn't one
+		path = s.scriptPath
+	case filepath.Dir(filepath.Dir(filepath.Dir(path))) == scriptDir &&
+		filepath.Base(filepath.Dir(filepath.Dir(path))) == "gorunbundle":
+		// another script of the bundle, see updateBundleTarget
+		base := strings.TrimSuffix(filepath.Base(path), ".go")
+		path = filepath.Join(scriptDir, base+".go")
+		if _, err := os.Stat(path); err != nil {
+			path = filepath.Join(scriptDir, base)
+		}
+	}
+	return path, true
+}
+
+// outputPathMapper writes the output of the go command, rewriting paths in the build tree (relative to where the
+// command ran, or absolute) to the original files, so errors point at the script, its extra source directory and
+// go.work libraries. Only whole lines are rewritten, Flush writes any final partial line
+type outputPathMapper struct {
+	s       *Script
+	w       io.Writer
+	pathsRe *regexp.Regexp
+	partial []byte
+}
+
+// mapOutputPaths returns a writer rewriting build tree paths in the go command's output before writing it to w
+func (s *Script) mapOutputPaths(w io.Writer) *outputPathMapper {
+	// relative paths as go prints them at the start of a line or after a space or quote, either ./x or ../lib/x, or a
+	// file with a line number (sub/x.go:12), and any absolute path in to the build tree
+	re := regexp.MustCompile(`(?m)(^|[\s"'(])(\.\.?/[^\s:"'()]*|[^\s:"'()/][^\s:"'()]*\.go)(:\d+)?|` +
+		regexp.QuoteMeta(s.buildTreeBase) + `[^\s:"'()]*`)
+	return &outputPathMapper{s: s, w: w, pathsRe: re}
+}
+
+func (m *outputPathMapper) Write(p []byte) (n int, err error) {
+	m.partial = append(m.partial, p...)
+	end := bytes.LastIndexByte(m.partial, '\n')
+	if end < 0 {
+		return len(p), nil
+	}
+	if _, err = m.w.Write(m.mapLines(m.partial[:end+1])); err != nil {
+		return 0, err
+	}
+	m.partial = append(m.partial[:0], m.partial[end+1:]...)
+	return len(p), nil
+}
+
+// Flush writes any output not ending in a newline
+func (m *outputPathMapper) Flush() (err error) {
+	if len(m.partial) > 0 {
+		_, err = m.w.Write(m.mapLines(m.partial))
+		m.partial = m.partial[:0]
+	}
+	return
+}
+
+// mapLines rewrites the paths in lines. A relative path is only rewritten if it is in the build tree, and has a line
+// number unless it starts ./ or ../, so words and module paths that happen to contain .go (script.go.bin,
+// example.com/x.go/pkg) are left alone
+func (m *outputPathMapper) mapLines(lines []byte) []byte {
+	return m.pathsRe.ReplaceAllFunc(lines, func(match []byte) []byte {
+		sub := m.pathsRe.FindSubmatch(match)
+		prefix, path, suffix := "", string(match), ""
+		if rel := string(sub[2]); rel != "" {
+			if len(sub[3]) == 0 && !strings.HasPrefix(rel, "./") && !strings.HasPrefix(rel, "../") {
+				return match
+			}
+			prefix, path, suffix = string(sub[1]), filepath.Join(m.s.buildTreeDir, filepath.FromSlash(rel)), string(sub[3])
+			if _, err := os.Lstat(path); err != nil {
+				return match
+			}
+		}
+		original, ok := m.s.originalPath(path)
+		if !ok {
+			return match
+		}
+		return []byte(prefix + original + suffix)
+	})
+}
@@ -0,0 +1,64 @@
+package script
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMapOutputPaths(t *testing.T) {
+	// the build tree mirrors the original paths under its base
+	base := filepath.Join(t.TempDir(), "tree")
+	s := &Script{
+		scriptPath:    "/home/u/hello.go",
+		buildTreeBase: base,
+		buildTreeDir:  filepath.Join(base, "home", "u"),
+	}
+	for _, name := range []string{"home/u/hello.go", "home/u/hello_/lib/lib.go", "home/lib/x.go"} {
+		path := filepath.Join(base, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"compiler error", "./hello.go:5:2: undefined: x", "/home/u/hello.go:5:2: undefined: x"},
+		{"compiler error in a subdirectory", "hello_/lib/lib.go:3:1: syntax error", "/home/u/hello_/lib/lib.go:3:1: syntax error"},
+		{"go.work library", "../lib/x.go:7: missing return", "/home/lib/x.go:7: missing return"},
+		{"vet package header", "# hello", "# hello"},
+		{"vet", "vet: ./hello.go:7:2: Println call has possible Printf formatting directive %d", "vet: /home/u/hello.go:7:2: Println call has possible Printf formatting directive %d"},
+		{"panic trace", "\tTREE/home/u/hello.go:12 +0x1d", "\t/home/u/hello.go:12 +0x1d"},
+		{"quoted directory", `directory "../lib" is outside the main module`, `directory "/home/lib" is outside the main module`},
+		{"module path", "go: finding module for package example.com/x.go/pkg", "go: finding module for package example.com/x.go/pkg"},
+		{"module path with a line number like suffix", "example.com/x.go:1.2 is not a file", "example.com/x.go:1.2 is not a file"},
+		{"file name without a line number", "unable to write script.go.bin: permission denied", "unable to write script.go.bin: permission denied"},
+		{".go file without a line number", "go: hello.go is not in the module", "go: hello.go is not in the module"},
+		{"not in the build tree", "other.go:3:1: undefined: y", "other.go:3:1: undefined: y"},
+		{"relative, not in the build tree", "../nowhere/x.go:3: undefined: y", "../nowhere/x.go:3: undefined: y"},
+		{"outside the build tree", "/usr/local/go/src/fmt/print.go:12 +0x1d", "/usr/local/go/src/fmt/print.go:12 +0x1d"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			m := s.mapOutputPaths(&out)
+			line := strings.ReplaceAll(tt.line, "TREE", base)
+			// written in two parts, as only whole lines are mapped
+			_, _ = m.Write([]byte(line[:len(line)/2]))
+			_, _ = m.Write([]byte(line[len(line)/2:] + "\n"))
+			if err := m.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if got := out.String(); got != tt.want+"\n" {
+				t.Errorf("got %q, want %q", got, tt.want+"\n")
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package script
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Pack writes an archive of the script and everything it is built from: its extra source directory, the go.work and
+// go.mod local directories, its bundle manifest (and the other scripts using it), and any module, go.env and declared
+// files alongside it on disc. Paths are kept relative to the directory holding them all, so the relative paths in
+// go.work and go.mod still work once unpacked, and the archive can be run anywhere with OpenArchive.
+// The format is chosen from out's name: .zip, .tar.gz (or .tgz), otherwise a .gorun file that can be run directly.
+// The script's .env file isn't included, as it belongs to the host
+func (s *Script) Pack(out string) (err error) {
+	if err = s.initVars(); err != nil {
+		return
+	}
+	out, err = filepath.Abs(out)
+	if err != nil {
+		return
+	}
+	files, dirs, err := s.packInputs()
+	if err != nil {
+		return
+	}
+	root := commonDir(append(append([]string{}, files...), dirs...))
+	scriptRel, err := filepath.Rel(root, s.scriptPath)
+	if err != nil {
+		return
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(out), "."+filepath.Base(out)+".*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name()) // gone once renamed in to place
+	w, mode := newArchiveWriter(f, out)
+	manifest := fmt.Sprintf("script %v\nroot %v\n", filepath.ToSlash(scriptRel), root)
+	err = w.add(ARCHIVE, nil, strings.NewReader(manifest), int64(len(manifest)))
+
+	seen := map[string]bool{out: true}
+	add := func(path string, info os.FileInfo) error {
+		if seen[path] {
+			return nil
+		}
+		seen[path] = true
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		return addPath(w, filepath.ToSlash(rel), path, info)
+	}
+	for _, file := range files {
+		if err != nil {
+			break
+		}
+		var info os.FileInfo
+		if info, err = os.Stat(file); err == nil {
+			err = add(file, info)
+		}
+	}
+	walker := s.walker()
+	for _, dir := range dirs {
+		if err != nil {
+			break
+		}
+		err = walker.walk(dir, add)
+	}
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to pack %v: %w", s.scriptPath, err)
+	}
+	s.log.Debug("packed script", "script", s.scriptPath, "archive", out, "root", root, "files", len(seen)-1)
+	return os.Rename(f.Name(), out)
+}
+
+// packInputs returns the files and directories Pack puts in the archive
+func (s *Script) packInputs() (files []string, dirs []string, err error) {
+	scriptDir := filepath.Dir(s.scriptPath)
+	files = []string{s.scriptPath}
+	dirs = s.sourceDirs()
+	if s.bundlePath != "" {
+		files = append(files, s.bundlePath)
+		scripts, err := s.bundleScripts()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, script := range scripts {
+			files = append(files, script)
+			extraDir := filepath.Join(filepath.Dir(script), strings.TrimSuffix(filepath.Base(script), ".go")+"_")
+			if info, err := os.Stat(extraDir); err == nil && info.IsDir() {
+				dirs = append(dirs, extraDir)
+			}
+		}
+	}
+	onDisc := func(name string) {
+		path := filepath.Join(scriptDir, filepath.FromSlash(name))
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+	}
+	for _, name := range append(append([]string{}, moduleFiles...), GOENV) {
+		onDisc(name)
+	}
+	declared, err := declaredFiles(s.content)
+	if err != nil {
+		return
+	}
+	for _, file := range declared {
+		if _, found := findSection(s.content, file.name); !found {
+			onDisc(file.name)
+		}
+	}
+	return
+}
+
+// archiveWriter writes the entries of an archive made by Pack
+type archiveWriter interface {
+	// add writes an entry, a regular file (with the default mode if info is nil), directory or symlink
+	add(name string, info os.FileInfo, r io.Reader, size int64) error
+	Close() error
+}
+
+// newArchiveWriter returns the writer for the format chosen by the archive's name, and the mode of the archive
+func newArchiveWriter(w io.Writer, name string) (aw archiveWriter, mode os.FileMode) {
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return zipArchive{zip.NewWriter(w)}, 0644
+	case strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz"):
+		return newTarArchive(w), 0644
+	}
+	_, _ = io.WriteString(w, ArchiveHeader) // any write error is seen again by the next write
+	return newTarArchive(w), 0755
+}
+
+// addPath writes the entry for a file or directory walked by Pack. info is for the symlink itself if it is being
+// recreated
+func addPath(w archiveWriter, name string, path string, info os.FileInfo) (err error) {
+	switch {
+	case info.IsDir():
+		return w.add(name, info, nil, 0)
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		return w.add(name, info, strings.NewReader(target), int64(len(target)))
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	return w.add(name, info, f, info.Size())
+}
+
+// tarArchive writes a gzipped tar
+type tarArchive struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func newTarArchive(w io.Writer) tarArchive {
+	gz := gzip.NewWriter(w)
+	return tarArchive{gz: gz, tw: tar.NewWriter(gz)}
+}
+
+func (a tarArchive) add(name string, info os.FileInfo, r io.Reader, size int64) (err error) {
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: size, Typeflag: tar.TypeReg, ModTime: time.Now()}
+	if info != nil {
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			link = string(target)
+		}
+		if hdr, err = tar.FileInfoHeader(info, link); err != nil {
+			return
+		}
+		// who packed it means nothing where it is unpacked
+		hdr.Name, hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = name, 0, 0, "", ""
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+	}
+	if err = a.tw.WriteHeader(hdr); err != nil {
+		return
+	}
+	if hdr.Typeflag == tar.TypeReg {
+		_, err = io.Copy(a.tw, r)
+	}
+	return
+}
+
+func (a tarArchive) Close() (err error) {
+	err = a.tw.Close()
+	if closeErr := a.gz.Close(); err == nil {
+		err = closeErr
+	}
+	return
+}
+
+// zipArchive writes a zip, symlinks holding their target as their contents
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (a zipArchive) add(name string, info os.FileInfo, r io.Reader, size int64) (err error) {
+	hdr := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()}
+	hdr.SetMode(0644)
+	if info != nil {
+		if hdr, err = zip.FileInfoHeader(info); err != nil {
+			return
+		}
+		hdr.Name, hdr.Method = name, zip.Deflate
+		if info.IsDir() {
+			hdr.Name, hdr.Method = name+"/", zip.Store
+		}
+	}
+	w, err := a.zw.CreateHeader(hdr)
+	if err != nil || r == nil {
+		return
+	}
+	_, err = io.Copy(w, r)
+	return
+}
+
+func (a zipArchive) Close() error {
+	return a.zw.Close()
+}
@@ -0,0 +1,218 @@
+package script
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// remoteCacheTimeout limits each request to an HTTP remote cache
+const remoteCacheTimeout = 2 * time.Minute
+
+// remoteCache shares compiled binaries between hosts. Each binary is stored under the hash of its inputs (see
+// inputHash), alongside '<hash>.sha256' holding the hex sha256 of the binary, checked when it is fetched
+type remoteCache interface {
+	// get returns the named object, found is false if it isn't in the cache
+	get(name string) (r io.ReadCloser, found bool, err error)
+	put(name string, r io.Reader, size int64) error
+}
+
+// newRemoteCache returns the cache at location, an http(s) URL or the path of a (shared) directory
+func newRemoteCache(location string) (cache remoteCache, err error) {
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		return httpCache{url: strings.TrimSuffix(location, "/"), client: &http.Client{Timeout: remoteCacheTimeout}}, nil
+	}
+	if !filepath.IsAbs(location) {
+		return nil, fmt.Errorf("remote cache %q must be an http(s) URL or an absolute directory path", location)
+	}
+	return dirCache{dir: location}, nil
+}
+
+// dirCache is a remote cache in a directory, e.g. on a shared filesystem
+type dirCache struct {
+	dir string
+}
+
+func (c dirCache) get(name string) (r io.ReadCloser, found bool, err error) {
+	f, err := os.Open(filepath.Join(c.dir, name))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return f, true, nil
+}
+
+// put writes to a temporary file then renames it in to place, so other hosts never see part of an object
+func (c dirCache) put(name string, r io.Reader, size int64) (err error) {
+	if err = os.MkdirAll(c.dir, 0755); err != nil {
+		return
+	}
+	f, err := os.CreateTemp(c.dir, "."+name+".*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	if _, err = io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return
+	}
+	if err = f.Chmod(0644); err != nil {
+		_ = f.Close()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	return os.Rename(f.Name(), filepath.Join(c.dir, name))
+}
+
+// httpCache is a remote cache served over HTTP: GET <url>/<name> fetches an object (404 if it isn't cached) and
+// PUT <url>/<name> stores one
+type httpCache struct {
+	url    string
+	client *http.Client
+}
+
+func (c httpCache) get(name string) (r io.ReadCloser, found bool, err error) {
+	resp, err := c.client.Get(c.url + "/" + name)
+	if err != nil {
+		return nil, false, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, true, nil
+	case http.StatusNotFound:
+		_ = resp.Body.Close()
+		return nil, false, nil
+	}
+	_ = resp.Body.Close()
+	return nil, false, fmt.Errorf("GET %v/%v: %v", c.url, name, resp.Status)
+}
+
+func (c httpCache) put(name string, r io.Reader, size int64) (err error) {
+	req, err := http.NewRequest(http.MethodPut, c.url+"/"+name, r)
+	if err != nil {
+		return
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("PUT %v/%v: %v", c.url, name, resp.Status)
+	}
+	return nil
+}
+
+// fetchRemote installs the binary for the inputs with hash from the remote cache, reporting whether it did. Any
+// problem (including a checksum mismatch) is logged and the script compiled as usual
+func (s *Script) fetchRemote(hash string) (fetched bool) {
+	if s.remoteCache == nil {
+		return false
+	}
+	err := s.fetchRemoteBinary(hash)
+	if errors.Is(err, errNotCached) {
+		s.log.Debug("binary not in the remote cache", "script", s.scriptPath, "hash", hash)
+		return false
+	} else if err != nil {
+		s.log.Warn("unable to fetch binary from the remote cache, compiling", "script", s.scriptPath, "hash", hash, "err", err)
+		return false
+	}
+	s.log.Info("fetched binary from the remote cache", "script", s.scriptPath, "hash", hash)
+	return true
+}
+
+// errNotCached is returned by fetchRemoteBinary if there is nothing in the remote cache for the inputs
+var errNotCached = errors.New("not cached")
+
+func (s *Script) fetchRemoteBinary(hash string) (err error) {
+	sumReader, found, err := s.remoteCache.get(hash + ".sha256")
+	if err != nil {
+		return
+	} else if !found {
+		return errNotCached
+	}
+	sum, err := io.ReadAll(io.LimitReader(sumReader, 1024))
+	_ = sumReader.Close()
+	if err != nil {
+		return
+	}
+	want, err := hex.DecodeString(string(bytes.TrimSpace(sum)))
+	if err != nil || len(want) != sha256.Size {
+		return fmt.Errorf("invalid checksum %q", bytes.TrimSpace(sum))
+	}
+
+	binReader, found, err := s.remoteCache.get(hash)
+	if err != nil {
+		return
+	} else if !found {
+		return errNotCached
+	}
+	defer binReader.Close()
+	out := fmt.Sprintf("%v.%d", s.binary, os.Getpid())
+	f, err := os.OpenFile(out, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return
+	}
+	defer os.Remove(out) // gone once installed
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), binReader)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+	if got := h.Sum(nil); !bytes.Equal(got, want) {
+		return fmt.Errorf("checksum mismatch, got %x want %x", got, want)
+	}
+	return s.installBinary(out)
+}
+
+// storeRemote uploads the freshly compiled binary to the remote cache under hash, then its checksum. Failures are
+// only logged, the binary was built
+func (s *Script) storeRemote(hash string) {
+	if s.remoteCache == nil {
+		return
+	}
+	err := s.storeRemoteBinary(hash)
+	if err != nil {
+		s.log.Warn("unable to store binary in the remote cache", "script", s.scriptPath, "hash", hash, "err", err)
+		return
+	}
+	s.log.Info("stored binary in the remote cache", "script", s.scriptPath, "hash", hash)
+}
+
+func (s *Script) storeRemoteBinary(hash string) (err error) {
+	f, err := os.Open(s.binary)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+	sum, err := fileHash(s.binary)
+	if err != nil {
+		return
+	}
+	if err = s.remoteCache.put(hash, f, info.Size()); err != nil {
+		return
+	}
+	// the checksum goes last, so the binary is complete before anyone will fetch it
+	checksum := hex.EncodeToString(sum[:]) + "\n"
+	return s.remoteCache.put(hash+".sha256", strings.NewReader(checksum), int64(len(checksum)))
+}
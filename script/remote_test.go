@@ -0,0 +1,130 @@
+package script
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memCache is a remote cache served over HTTP from memory
+type memCache struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (c *memCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	switch r.Method {
+	case http.MethodGet:
+		object, found := c.objects[name]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(object)
+	case http.MethodPut:
+		object, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.objects[name] = object
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeHost writes the same script, with an extra source directory, under dir, as another host would have it
+func writeHost(t *testing.T, dir string) (path string) {
+	t.Helper()
+	path = filepath.Join(dir, "hello.go")
+	modTime := time.Now().Add(-time.Hour)
+	writeScript(t, path, `fmt.Println(greet.Hello())`, modTime)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content = bytes.Replace(content, []byte(`import "fmt"`), []byte("import (\n\t\"fmt\"\n\n\t\"hello/hello_/greet\"\n)"), 1)
+	if err = os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	greet := filepath.Join(dir, "hello_", "greet")
+	if err = os.MkdirAll(greet, 0755); err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(greet, "greet.go"), []byte("package greet\n\nfunc Hello() string { return \"hi\" }\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// buildOnHost builds the script in dir, with its own cache directory as another host would, returning the log
+func buildOnHost(t *testing.T, dir string, remoteCache string) (log string) {
+	t.Helper()
+	var logs bytes.Buffer
+	s, err := New(writeHost(t, dir), Options{
+		TmpDirBase:  t.TempDir(),
+		RemoteCache: remoteCache,
+		Logger:      slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := s.Command()
+	if err != nil {
+		t.Fatalf("build: %v\n%s", err, logs.String())
+	}
+	if out, err := cmd.Output(); err != nil || string(out) != "hi\n" {
+		t.Fatalf("run: got %q, %v", out, err)
+	}
+	return logs.String()
+}
+
+func TestHTTPRemoteCache(t *testing.T) {
+	needsGo(t)
+	cache := &memCache{objects: map[string][]byte{}}
+	server := httptest.NewServer(cache)
+	defer server.Close()
+
+	// a miss, so it compiles and stores the binary and its checksum
+	log := buildOnHost(t, t.TempDir(), server.URL)
+	for _, want := range []string{"binary not in the remote cache", "compiling script", "stored binary in the remote cache"} {
+		if !strings.Contains(log, want) {
+			t.Errorf("first host: expected %q in the log:\n%s", want, log)
+		}
+	}
+	if len(cache.objects) != 2 {
+		t.Fatalf("expected the binary and its checksum to be stored, got %d objects", len(cache.objects))
+	}
+
+	// a hit, even though the script is somewhere else on this host
+	log = buildOnHost(t, t.TempDir(), server.URL)
+	if !strings.Contains(log, "fetched binary from the remote cache") || strings.Contains(log, "compiling script") {
+		t.Errorf("second host: expected the binary to be fetched, not compiled:\n%s", log)
+	}
+
+	// a corrupt binary is refused, and the script compiled
+	for name, object := range cache.objects {
+		if !strings.HasSuffix(name, ".sha256") {
+			cache.objects[name] = append(object, 0)
+		}
+	}
+	log = buildOnHost(t, t.TempDir(), server.URL)
+	for _, want := range []string{"checksum mismatch", "compiling script"} {
+		if !strings.Contains(log, want) {
+			t.Errorf("corrupt binary: expected %q in the log:\n%s", want, log)
+		}
+	}
+}
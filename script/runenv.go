@@ -0,0 +1,116 @@
+package script
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// RUNENV is the section of environment changes applied when the script is run (unlike go.env, which is only used to
+// build it), one per line:
+//
+//	// run.env >>>
+//	// :GOMAXPROCS=2
+//	// :GOMEMLIMIT?=512MiB
+//	// :PATH=/opt/tool/bin:${PATH}
+//	// :-HTTP_PROXY
+//	// <<< run.env
+//
+// 'KEY=value' sets a variable, 'KEY?=value' sets it only if it isn't already set and '-KEY' unsets it. ${VAR} in a
+// value is replaced by the variable's value so far (empty if unset). Blank lines and lines starting with '#' are
+// ignored. A file alongside the script, named after it with a .env extension (e.g. myscript.env for myscript.go), is
+// applied after the section in the same way, so a host can override it.
+const RUNENV = "run.env"
+
+// runEnvVarRe matches ${VAR} in a run.env value
+var runEnvVarRe = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// runEnvFile returns the path of the env file alongside the script
+func (s *Script) runEnvFile() string {
+	return strings.TrimSuffix(s.scriptPath, ".go") + ".env"
+}
+
+// runEnv returns the environment the script is run with: this process's environment, changed by the run.env
+// section then the env file alongside the script, if there is one
+func (s *Script) runEnv() (env []string, err error) {
+	env = os.Environ()
+	if section, found := findSection(s.content, RUNENV); found {
+		env, err = applyRunEnv(env, section.Content, s.scriptPath, section.StartLine+1)
+		if err != nil {
+			return
+		}
+	}
+	file := s.runEnvFile()
+	content, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return env, nil
+	} else if err != nil {
+		return
+	}
+	s.log.Debug("applying run environment file", "script", s.scriptPath, "file", file)
+	return applyRunEnv(env, content, file, 1)
+}
+
+// applyRunEnv applies each line of content (see RUNENV) to env in turn. Errors name the source file and line, the
+// first line of content being firstLine
+func applyRunEnv(env []string, content []byte, source string, firstLine int) (changed []string, err error) {
+	changed = env
+	for i, line := range strings.Split(string(content), "\n") {
+		lineNum := firstLine + i
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if key, found := strings.CutPrefix(line, "-"); found {
+			if !validEnvKey(key) {
+				return nil, fmt.Errorf("%v:%d: invalid variable to unset %q", source, lineNum, key)
+			}
+			changed = unsetEnvVar(changed, key)
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("%v:%d: expected 'KEY=value', 'KEY?=value' or '-KEY', got %q", source, lineNum, line)
+		}
+		key, isDefault := strings.CutSuffix(key, "?")
+		if !validEnvKey(key) {
+			return nil, fmt.Errorf("%v:%d: invalid variable name %q", source, lineNum, key)
+		}
+		if _, set := lookupEnvVar(changed, key); set && isDefault {
+			continue
+		}
+		value = runEnvVarRe.ReplaceAllStringFunc(value, func(ref string) string {
+			value, _ := lookupEnvVar(changed, ref[2:len(ref)-1])
+			return value
+		})
+		changed = append(unsetEnvVar(changed, key), key+"="+value)
+	}
+	return
+}
+
+// validEnvKey reports whether key can be used as an environment variable name
+func validEnvKey(key string) bool {
+	return key != "" && !strings.ContainsAny(key, "= \t")
+}
+
+// lookupEnvVar returns the value of an environment variable, and whether it is set at all
+func lookupEnvVar(env []string, key string) (value string, set bool) {
+	for i := len(env) - 1; i >= 0; i-- {
+		if value, found := strings.CutPrefix(env[i], key+"="); found {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// unsetEnvVar returns env without any entries for key
+func unsetEnvVar(env []string, key string) (unset []string) {
+	unset = make([]string, 0, len(env))
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, key+"=") {
+			unset = append(unset, kv)
+		}
+	}
+	return
+}
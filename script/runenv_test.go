@@ -0,0 +1,109 @@
+package script
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyRunEnv(t *testing.T) {
+	base := []string{"HOME=/home/a", "PATH=/bin", "HTTP_PROXY=http://proxy"}
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+		wantErr string
+	}{{
+		name:    "nothing",
+		content: "",
+		want:    base,
+	}, {
+		name:    "blank lines and comments",
+		content: "\n  \n# A=1\n",
+		want:    base,
+	}, {
+		name:    "set",
+		content: "GOMAXPROCS=2",
+		want:    []string{"HOME=/home/a", "PATH=/bin", "HTTP_PROXY=http://proxy", "GOMAXPROCS=2"},
+	}, {
+		name:    "replace",
+		content: "HOME=/tmp",
+		want:    []string{"PATH=/bin", "HTTP_PROXY=http://proxy", "HOME=/tmp"},
+	}, {
+		name:    "empty value",
+		content: "HOME=",
+		want:    []string{"PATH=/bin", "HTTP_PROXY=http://proxy", "HOME="},
+	}, {
+		name:    "value containing =",
+		content: "OPTS=a=b",
+		want:    []string{"HOME=/home/a", "PATH=/bin", "HTTP_PROXY=http://proxy", "OPTS=a=b"},
+	}, {
+		name:    "default when set",
+		content: "HOME?=/tmp",
+		want:    base,
+	}, {
+		name:    "default when unset",
+		content: "GOMEMLIMIT?=512MiB",
+		want:    []string{"HOME=/home/a", "PATH=/bin", "HTTP_PROXY=http://proxy", "GOMEMLIMIT=512MiB"},
+	}, {
+		name:    "unset",
+		content: "-HTTP_PROXY",
+		want:    []string{"HOME=/home/a", "PATH=/bin"},
+	}, {
+		name:    "unset what isn't set",
+		content: "-NOT_SET",
+		want:    base,
+	}, {
+		name:    "expanded",
+		content: "PATH=/opt/tool/bin:${PATH}",
+		want:    []string{"HOME=/home/a", "HTTP_PROXY=http://proxy", "PATH=/opt/tool/bin:/bin"},
+	}, {
+		name:    "expanded from an earlier line",
+		content: "-HTTP_PROXY\nA=1\nB=${A}${HTTP_PROXY}2",
+		want:    []string{"HOME=/home/a", "PATH=/bin", "A=1", "B=12"},
+	}, {
+		name:    "only braces are expanded",
+		content: "A=$HOME",
+		want:    []string{"HOME=/home/a", "PATH=/bin", "HTTP_PROXY=http://proxy", "A=$HOME"},
+	}, {
+		name:    "surrounding space",
+		content: "  A=1  ",
+		want:    []string{"HOME=/home/a", "PATH=/bin", "HTTP_PROXY=http://proxy", "A=1"},
+	}, {
+		name:    "not an assignment",
+		content: "A=1\nGOMAXPROCS 2",
+		wantErr: `myscript.env:11: expected 'KEY=value', 'KEY?=value' or '-KEY', got "GOMAXPROCS 2"`,
+	}, {
+		name:    "no name",
+		content: "=1",
+		wantErr: `myscript.env:10: invalid variable name ""`,
+	}, {
+		name:    "space in the name",
+		content: "\nA B=1",
+		wantErr: `myscript.env:11: invalid variable name "A B"`,
+	}, {
+		name:    "no name to unset",
+		content: "-",
+		wantErr: `myscript.env:10: invalid variable to unset ""`,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := append([]string{}, base...)
+			got, err := applyRunEnv(env, []byte(tt.content), "myscript.env", 10)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("got %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(env, base) {
+				t.Errorf("changed the environment passed in: %q", env)
+			}
+		})
+	}
+}
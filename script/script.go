@@ -0,0 +1,768 @@
+// Package script compiles and runs go source "scripts", as used by the gorun command.
+//
+// A script is a single go file (optionally with an extra source directory alongside it, named after the script with
+// a trailing '_', and go.work "shared libraries") that carries its go.mod, go.sum etc. embedded as comments. The
+// script is copied to a build tree, compiled, and the binary cached until the source changes.
+//
+//	s, err := script.New("/usr/local/bin/myscript.go", script.Options{Logger: logger})
+//	if err != nil {
+//		return err
+//	}
+//	cmd, err := s.Command("-port", "8080") // compiles if required
+//
+// Nothing in this package writes to stdout or exits the process, errors are returned and diagnostics are logged
+// via Options.Logger.
+package script
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Names of the files that can be embedded in a script as commented sections
+const (
+	GOMOD     = "go.mod"
+	GOSUM     = "go.sum"
+	GOWORK    = "go.work"
+	GOWORKSUM = "go.work.sum"
+	GOENV     = "go.env"
+)
+
+// Toolchain policies, for when the toolchain pinned by go.mod isn't installed in Options.ToolchainDir
+const (
+	ToolchainFallback = "fallback" // build with the installed go, logging a warning
+	ToolchainRequire  = "require"  // fail
+)
+
+// Defaults used for zero valued Options
+const (
+	DefaultTmpDirBase         = "/var/tmp"
+	DefaultCleanSecs          = 14 * 24 * 3600
+	DefaultCleanSecsBuildDirs = 1 * 3600
+)
+
+// Options control how a script is built and where the binaries are cached
+type Options struct {
+	// RecompileWrongGoVer recompiles the binary if it wasn't compiled with the installed go version
+	RecompileWrongGoVer bool
+	// TmpDirBase is where the per user cache directory is created, DefaultTmpDirBase if empty
+	TmpDirBase string
+	// CleanSecs removes binaries (of any script) not run within this many seconds. DefaultCleanSecs if zero,
+	// negative disables cleaning
+	CleanSecs int64
+	// CleanSecsBuildDirs removes build directories left behind (e.g. by crashes) older than this.
+	// DefaultCleanSecsBuildDirs if zero
+	CleanSecsBuildDirs int64
+	// ToolchainDir, if set, holds go toolchains named by version (e.g. /usr/local for /usr/local/go1.24.2/bin/go),
+	// and the toolchain pinned by the embedded go.mod is used to build
+	ToolchainDir string
+	// ToolchainPolicy is ToolchainFallback (the default) or ToolchainRequire
+	ToolchainPolicy string
+	// Symlinks in the extra source directory and go.work libraries are SymlinksRecreate'd (the default) in the build
+	// tree, or SymlinksFollow'ed
+	Symlinks string
+	// FallbackLastGood runs the last binary that compiled (see Run and Command) if the script now fails to compile,
+	// with a warning written to BuildOutput and logged
+	FallbackLastGood bool
+	// Hermetic builds the script with only part of the caller's environment (PATH, HOME, proxies and where the go
+	// command keeps its files) plus the embedded go.env, so e.g. a stray GOFLAGS or CGO_ENABLED can't change the binary.
+	// The effective build environment is part of the cache variant
+	Hermetic bool
+	// RemoteCache is where compiled binaries are shared between hosts: the path of a (shared) directory, or an
+	// http(s) URL served by GET/PUT. Binaries are fetched from it, rather than compiled, when the inputs match
+	RemoteCache string
+	// RetryFailed compiles the script even if the last compile failed with the same inputs, rather than returning
+	// that failure again
+	RetryFailed bool
+	// BuildOutput receives the output of go build as it runs, it is discarded if nil.
+	// It is also returned in a BuildError if the build fails
+	BuildOutput io.Writer
+	// Logger receives diagnostics, e.g. why a script is being recompiled. Discarded if nil
+	Logger *slog.Logger
+}
+
+// BuildError is returned when go build fails, holding the compiler's output
+type BuildError struct {
+	Output []byte
+	Err    error
+	Cached bool // the failure of an earlier compile of the same inputs, replayed rather than compiling again
+}
+
+func (e *BuildError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *BuildError) Unwrap() error {
+	return e.Err
+}
+
+// Script is a go source file that can be compiled and run
+type Script struct {
+	log                 *slog.Logger
+	recompileWrongGoVer bool        // recompile the binary if the go version doesn't match the installed version
+	retryFailed         bool        // compile even if the last compile of the same inputs failed
+	fallbackLastGood    bool        // run the last binary that compiled if the script fails to compile
+	remoteCache         remoteCache // binaries shared between hosts, nil if none
+	hermetic            bool        // build from the allowed part of the caller's environment plus go.env only
+	buildOutput         io.Writer
+	initialised         bool   // initVars has been run
+	name                string // the script path as given, used as argv[0]
+	content             []byte // contents of the primary script.go file
+	sections            []Section
+	bundlePath          string // full path to the bundle manifest the module files are taken from, empty if none
+	bundleSections      []Section
+	scriptPath          string   // full path to the primary script.go file
+	scriptExtraDir      string   // full path to any extra script dir
+	scriptLocalDirs     []string // full path to any local directories used by go.work or replaced by go.work/go.mod
+	archiveRoot         string   // where the files of a script run from an archive were packed from, empty if not
+	unpackedRoot        string   // where the files of a script run from an archive were unpacked to
+	toolchainDir        string   // directory holding go toolchains named by version, e.g. /usr/local for /usr/local/go1.24.2
+	toolchainPolicy     string   // what to do if the toolchain pinned by go.mod isn't in toolchainDir: fallback or require
+	symlinks            string   // SymlinksRecreate or SymlinksFollow
+	pinnedGoVersion     string   // version of the toolchain selected from toolchainDir, e.g. go1.24.2, empty if not pinned
+	gobin               string   // go binary used to build, see goBinary()
+	tmpDirBase          string   // where to write subdirectories to
+	perUserTmpDir       string   // subdirectory containing all this user's commands (a sub of tmpDirBase)
+	scriptTmpDir        string   // subdirectory containing this user's versions of the command (a sub of perUserTmpDir)
+	tmpDir              string   // subdirectory for this toolchain/GOOS/GOARCH variant of the command (a sub of scriptTmpDir)
+	buildTreeBase       string   // persistent build tree, mirroring the absolute paths of the script and its directories
+	buildTreeDir        string   // the script's directory within the build tree, where go build is run
+	buildLock           string   // file locked while the build tree is updated and built from
+	failedBuild         string   // the input hash and output of the last compile, if it failed
+	binary              string   // moving the binary to <tmpDir>/script.go.bin just before compiled binary final resting place, lives under tmpDir
+	binaryPrev          string   // the binary replaced by the last compile, kept as a last known good fallback
+	binaryLastRun       string   // file showing the binary was run lately (for filesystems not running atime)
+	cleanSecs           int64    // any binaries not accessed within this number of seconds get deleted (and rebuilt)
+	cleanSecsBuildDirs  int64    // any build directories for this binary older than this get deleted
+}
+
+// New returns the script at scriptPath, which must exist. Symlinks are resolved, so the cached binary is shared
+// however the script is reached.
+func New(scriptPath string, opts Options) (s *Script, err error) {
+	s = &Script{
+		log:                 opts.Logger,
+		recompileWrongGoVer: opts.RecompileWrongGoVer,
+		retryFailed:         opts.RetryFailed,
+		fallbackLastGood:    opts.FallbackLastGood,
+		hermetic:            opts.Hermetic,
+		buildOutput:         opts.BuildOutput,
+		name:                scriptPath,
+		toolchainDir:        opts.ToolchainDir,
+		toolchainPolicy:     opts.ToolchainPolicy,
+		symlinks:            opts.Symlinks,
+		tmpDirBase:          opts.TmpDirBase,
+		cleanSecs:           opts.CleanSecs,
+		cleanSecsBuildDirs:  opts.CleanSecsBuildDirs,
+	}
+	if s.log == nil {
+		s.log = slog.New(slog.DiscardHandler)
+	}
+	if s.buildOutput == nil {
+		s.buildOutput = io.Discard
+	}
+	if s.toolchainPolicy == "" {
+		s.toolchainPolicy = ToolchainFallback
+	}
+	if opts.RemoteCache != "" {
+		s.remoteCache, err = newRemoteCache(opts.RemoteCache)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch s.symlinks {
+	case "":
+		s.symlinks = SymlinksRecreate
+	case SymlinksRecreate, SymlinksFollow:
+	default:
+		return nil, fmt.Errorf("unknown symlink policy %q, must be %q or %q", s.symlinks, SymlinksRecreate, SymlinksFollow)
+	}
+	if s.tmpDirBase == "" {
+		s.tmpDirBase = DefaultTmpDirBase
+	}
+	if s.cleanSecs == 0 {
+		s.cleanSecs = DefaultCleanSecs
+	}
+	if s.cleanSecsBuildDirs == 0 {
+		s.cleanSecsBuildDirs = DefaultCleanSecsBuildDirs
+	}
+	s.scriptPath, err = realPath(scriptPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find source file: %w", err)
+	}
+	return s, nil
+}
+
+// Path returns the full path to the script, symlinks resolved
+func (s *Script) Path() string {
+	return s.scriptPath
+}
+
+// Binary returns where the compiled binary of the script is cached
+func (s *Script) Binary() (binary string, err error) {
+	err = s.initVars()
+	return s.binary, err
+}
+
+// realPath returns the real absolute path, resolving symlinks
+func realPath(sourceFile string) (realPath string, err error) {
+	sourceFile, err = filepath.Abs(sourceFile)
+	if err != nil {
+		return
+	}
+	realPath, err = filepath.EvalSymlinks(sourceFile)
+	return
+}
+
+// initVars fills in commonly used variables (paths), e.g. what is the path to the script binary.
+// It reads the contents of the go script, to be able to extract the go.work section and also allow
+// any go.work "shared libraries" to be copied over to the build tree too.
+// It only does this once, any later calls do nothing.
+func (s *Script) initVars() (err error) {
+	if s.initialised {
+		return nil
+	}
+	perUserTmpDir, err := perUserTmpDirName()
+	if err != nil {
+		return
+	}
+	s.content, err = os.ReadFile(s.scriptPath)
+	if err != nil {
+		return
+	}
+	s.sections, err = ParseSections(s.content)
+	if err != nil {
+		return fmt.Errorf("malformed embedded sections in %v: %w", s.scriptPath, err)
+	}
+	err = s.loadBundle()
+	if err != nil {
+		return
+	}
+
+	scriptTmpDir := filepath.Join(perUserTmpDir,
+		strings.ReplaceAll(s.scriptPath, string(filepath.Separator), "_"))
+
+	s.perUserTmpDir = filepath.Join(s.tmpDirBase, perUserTmpDir)
+	s.scriptTmpDir = filepath.Join(s.tmpDirBase, scriptTmpDir)
+	if strings.HasSuffix(s.scriptPath, ".go") {
+		s.scriptExtraDir = s.scriptPath[:len(s.scriptPath)-3] + "_"
+	} else {
+		s.scriptExtraDir = s.scriptPath + "_"
+	}
+	fileinfo, err := os.Stat(s.scriptExtraDir)
+	if err != nil || !fileinfo.IsDir() {
+		err = nil
+		s.scriptExtraDir = ""
+	}
+	// any local directories used by go.work or replaced in go.mod are copied in to the build tree too
+	s.scriptLocalDirs, err = s.localDirs()
+	if err != nil {
+		return
+	}
+
+	if s.toolchainDir != "" {
+		err = s.pinToolchain()
+		if err != nil {
+			return
+		}
+	}
+
+	// each toolchain/platform combination gets its own binary, so they don't keep invalidating each other
+	variant, err := s.cacheVariant()
+	if err != nil {
+		return
+	}
+	s.tmpDir = filepath.Join(s.scriptTmpDir, variant)
+	s.buildTreeBase = filepath.Join(s.tmpDir, "tree")
+	s.buildTreeDir = filepath.Join(s.buildTreeBase, filepath.Dir(s.scriptPath))
+	s.buildLock = filepath.Join(s.tmpDir, ".lock")
+	s.failedBuild = filepath.Join(s.tmpDir, ".failed")
+	s.binary = filepath.Join(s.tmpDir, filepath.Base(s.scriptPath)+".bin")
+	s.binaryPrev = s.binary + ".prev"
+	s.binaryLastRun = filepath.Join(s.tmpDir, ".lastRun")
+	s.initialised = true
+	return
+}
+
+// perUserTmpDirName returns the name of the directory, under the tmp dir base, holding all this user's files
+func perUserTmpDirName() (name string, err error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return
+	}
+	return fmt.Sprintf("gorun-%v-%v", hostname, os.Getuid()), nil
+}
+
+// section returns the contents of an embedded section of the script, empty if not found. The module files and
+// go.env come from the bundle manifest if the script uses one
+func (s *Script) section(sectionName string) []byte {
+	sections := s.sections
+	if s.bundlePath != "" && isBundleFile(sectionName) {
+		sections = s.bundleSections
+	}
+	for _, section := range sections {
+		if section.Name == sectionName {
+			return section.Content
+		}
+	}
+	return []byte("")
+}
+
+func touchFile(file string, onlyIfExists bool) (err error) {
+	_, err = os.Stat(file)
+	if os.IsNotExist(err) {
+		if !onlyIfExists {
+			var f *os.File
+			f, err = os.Create(file)
+			defer f.Close()
+		}
+	} else {
+		currentTime := time.Now().Local()
+		err = os.Chtimes(file, currentTime, currentTime)
+	}
+	return
+}
+
+// markRun marks when the binary was last run (by touching a file alongside the binary), so clean leaves it alone.
+// The binary itself is left alone when it is only being run as a fallback, as touching it would make it look newer
+// than the source that failed to compile, and so up to date
+func (s *Script) markRun(fallback bool) {
+	if s.cleanSecs >= 0 {
+		_ = touchFile(s.binaryLastRun, false)
+		if !fallback {
+			_ = touchFile(s.binary, true)
+		}
+	}
+}
+
+// Build compiles the script if the cached binary is out of date, first cleaning any binaries (of any script) that
+// haven't been run for a while
+func (s *Script) Build() (err error) {
+	err = s.initVars()
+	if err != nil {
+		return
+	}
+
+	if s.cleanSecs >= 0 {
+		s.clean()
+	}
+	return s.build()
+}
+
+// build compiles the script if required, waiting for any other process already building it
+func (s *Script) build() (err error) {
+	outOfDate, err := s.targetOutOfDate()
+	if err != nil {
+		return // can't find the source file - let's bail
+	}
+
+	if outOfDate {
+		// Wait for any active build to complete before starting our own
+		unlock, err := s.lockBuildTree()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		// maybe it was built (or failed to) while we were waiting?
+		outOfDate, err = s.targetOutOfDate()
+		if err != nil {
+			return err // can't find the source file - let's bail
+		}
+		if !outOfDate {
+			return nil
+		}
+		// the input hash reads every source file, so is only worked out if a cache keyed by it is used
+		hash := ""
+		if !s.retryFailed || s.remoteCache != nil {
+			if hash, err = s.inputHash(); err != nil {
+				return err
+			}
+		}
+		// don't hammer the host compiling the same broken source over and over, e.g. from cron
+		if err = s.cachedFailure(hash); err != nil {
+			return err
+		}
+		if s.fetchRemote(hash) {
+			return nil
+		}
+		err = s.compile() // can't compile, well, it could be inconsistent source, let's bail
+		s.recordFailure(hash, err)
+		if err == nil {
+			s.storeRemote(hash)
+		}
+		return err
+	}
+	return
+}
+
+// buildOrLastGood runs build (Build or build), returning the binary to run. If the script fails to compile and
+// Options.FallbackLastGood is set, the last binary that compiled is returned instead, loudly, and fallback is true
+func (s *Script) buildOrLastGood(build func() error) (binary string, fallback bool, err error) {
+	err = build()
+	var buildErr *BuildError
+	if err == nil || !s.fallbackLastGood || !errors.As(err, &buildErr) {
+		return s.binary, false, err
+	}
+	binary = s.lastGoodBinary()
+	if binary == "" {
+		return "", false, err
+	}
+	info, statErr := os.Stat(binary)
+	if statErr != nil {
+		return "", false, err
+	}
+	s.log.Warn("script failed to compile, running the last binary that compiled", "script", s.scriptPath,
+		"binary", binary, "compiled", info.ModTime().Format(time.RFC3339), "err", err)
+	_, _ = fmt.Fprintf(s.buildOutput, "gorun: WARNING: %v failed to compile, running the last binary that compiled (%v, %v)\n",
+		s.scriptPath, binary, info.ModTime().Format(time.RFC3339))
+	return binary, true, nil
+}
+
+// lastGoodBinary returns the binary of the last compile that worked, empty if there isn't one. That is the cached
+// binary, as a failed compile leaves it alone, unless it is unreadable (e.g. zeroed by an unclean shutdown), when the
+// one it replaced is tried
+func (s *Script) lastGoodBinary() (binary string) {
+	gobin, err := s.goBinary()
+	if err != nil {
+		return ""
+	}
+	for _, binary = range []string{s.binary, s.binaryPrev} {
+		if info, err := os.Stat(binary); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if _, err = compiledVersion(gobin, binary); err == nil {
+			return binary
+		}
+	}
+	return ""
+}
+
+// Run compiles the script if required and replaces the current process with the binary, passing it args
+// (not including the program name, the script path given to New is used for that). It only returns on error
+func (s *Script) Run(args ...string) (err error) {
+	binary, fallback, err := s.buildOrLastGood(s.Build)
+	if err != nil {
+		return
+	}
+	env, err := s.runEnv()
+	if err != nil {
+		return
+	}
+	// we could be getting called multiple times simultaneously, with source code changing under
+	// our feet too. We could also get our directory deleted entirely from under us as part of
+	// a clean up, so let's try multiple times
+	for i := 0; i < 5; i++ {
+		if i > 0 {
+			binary, fallback, err = s.buildOrLastGood(s.build)
+			if err != nil {
+				return
+			}
+		}
+		s.markRun(fallback)
+		err = syscall.Exec(binary, append([]string{s.name}, args...), env)
+		if !os.IsNotExist(err) {
+			break // we ran, must be a real error
+		}
+	}
+	return
+}
+
+// Command compiles the script if required and returns a command to run the binary with args, for when the
+// current process shouldn't be replaced
+func (s *Script) Command(args ...string) (cmd *exec.Cmd, err error) {
+	binary, fallback, err := s.buildOrLastGood(s.Build)
+	if err != nil {
+		return
+	}
+	env, err := s.runEnv()
+	if err != nil {
+		return
+	}
+	s.markRun(fallback)
+	cmd = exec.Command(binary, args...)
+	cmd.Env = env
+	cmd.Args[0] = s.name
+	return
+}
+
+// OutOfDate reports whether the script needs compiled
+func (s *Script) OutOfDate() (outOfDate bool, err error) {
+	err = s.initVars()
+	if err != nil {
+		return
+	}
+	return s.targetOutOfDate()
+}
+
+// Explain returns every reason the script would be recompiled, empty if the binary is up to date.
+// Nothing is built or run
+func (s *Script) Explain() (reasons []string, err error) {
+	err = s.initVars()
+	if err != nil {
+		return
+	}
+	return s.outOfDateReasons(true)
+}
+
+// Clean removes binaries (of any script run by this user) that haven't been run for Options.CleanSecs, and
+// build directories left behind older than Options.CleanSecsBuildDirs
+func (s *Script) Clean() (err error) {
+	err = s.initVars()
+	if err != nil {
+		return
+	}
+	return s.clean()
+}
+
+// targetOutOfDate returns if the target needs recompiled, is the source newer than the binary or go version is "too old"?
+func (s *Script) targetOutOfDate() (outOfDate bool, err error) {
+	reasons, err := s.outOfDateReasons(false)
+	for _, reason := range reasons {
+		s.log.Debug("target out of date", "script", s.scriptPath, "reason", reason)
+	}
+	return len(reasons) > 0 || err != nil, err
+}
+
+// outOfDateReasons returns why the target needs recompiled, empty if it is up-to-date.
+// If all is false it stops at the first reason found, otherwise every reason is collected (for -explain).
+func (s *Script) outOfDateReasons(all bool) (reasons []string, err error) {
+	// target doesn't exist?
+	binaryInfo, binStatErr := os.Stat(s.binary)
+	if binStatErr != nil {
+		return []string{fmt.Sprintf("binary %v is missing", s.binary)}, nil
+	}
+	if binaryInfo.IsDir() {
+		return []string{fmt.Sprintf("binary %v is a directory", s.binary)}, nil
+	}
+	binaryTime := binaryInfo.ModTime()
+
+	err = s.walkInputs(func(path string, info os.FileInfo) error {
+		if !info.ModTime().After(binaryTime) {
+			return nil
+		}
+		what := path
+		switch path {
+		case s.scriptPath:
+			what = "script " + path
+		case s.bundlePath:
+			what = "bundle " + path
+		}
+		reasons = append(reasons, fmt.Sprintf("%v is newer than the binary (%v > %v)",
+			what, info.ModTime().Format(time.RFC3339Nano), binaryTime.Format(time.RFC3339Nano)))
+		if !all {
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		return reasons, err
+	}
+	if len(reasons) > 0 && !all {
+		return
+	}
+
+	// check the binary was compiled with the same version of go installed on the system.
+	// we have seen binaries filled with zeros on unclean shutdowns, this first stage should also catch that, so
+	// run it outside the s.recompileWrongGoVer check.
+	gobin, err := s.goBinary()
+	if err != nil {
+		return reasons, err
+	}
+	fileVersion, err := compiledVersion(gobin, s.binary)
+	if err != nil {
+		// recompile in case it is a corrupt binary but not pollute its stdout/stderr
+		return append(reasons, fmt.Sprintf("unable to read the go version from the binary, corrupt? (%v)", err)), nil
+	}
+	if s.pinnedGoVersion != "" {
+		// a pinned toolchain is always honoured, no need to run "go version" as the directory name is the version
+		if s.pinnedGoVersion != fileVersion {
+			reasons = append(reasons, fmt.Sprintf("binary was compiled with %v but go.mod pins %v", fileVersion, s.pinnedGoVersion))
+		}
+	} else if s.recompileWrongGoVer {
+		// If not, further check if the binary was compiled with the version of go installed on the system
+		gobinVersion, err := installedGoVersion(gobin)
+		if err != nil {
+			// we couldn't run "go version" for some reason, let's fail now
+			return reasons, err
+		}
+		if gobinVersion != fileVersion {
+			reasons = append(reasons, fmt.Sprintf("binary was compiled with %v but %v is installed", fileVersion, gobinVersion))
+		}
+	}
+	return reasons, nil
+}
+
+// sourceDirs returns the directories copied in to the build tree: the extra source directory, if any, then the
+// go.work libraries and local replace directories
+func (s *Script) sourceDirs() (dirs []string) {
+	if s.scriptExtraDir != "" {
+		dirs = append(dirs, s.scriptExtraDir)
+	}
+	return append(dirs, s.scriptLocalDirs...)
+}
+
+// walkInputs calls fn for everything the binary is compiled from, and checked against it for being out of date: the
+// script, its bundle manifest, then every file and directory in the source directories, including what a recreated
+// absolute symlink points to. Returning filepath.SkipAll stops the walk
+func (s *Script) walkInputs(fn walkFunc) (err error) {
+	stopped := false
+	var visit walkFunc
+	visit = func(path string, info os.FileInfo) error {
+		err := fn(path, info)
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			if err = s.walkLinkTarget(path, visit); stopped {
+				err = filepath.SkipAll
+			}
+		}
+		if errors.Is(err, filepath.SkipAll) {
+			stopped = true
+		}
+		return err
+	}
+	files := []string{s.scriptPath}
+	if s.bundlePath != "" {
+		files = append(files, s.bundlePath)
+	}
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		if err = visit(file, info); stopped {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	w := s.walker()
+	for _, dir := range s.sourceDirs() {
+		if err = w.walk(dir, visit); err != nil || stopped {
+			return
+		}
+	}
+	return nil
+}
+
+// walkLinkTarget calls fn for what an absolute symlink recreated in the build tree points to, named as if under the
+// link. The build reads through it to files that aren't copied, so they are inputs all the same. A relative symlink
+// points within the directories copied, so is already walked, and a broken one only fails the build if it's used
+func (s *Script) walkLinkTarget(link string, fn walkFunc) (err error) {
+	target, err := os.Readlink(link)
+	if err != nil || !filepath.IsAbs(target) {
+		return
+	}
+	real, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		return nil
+	}
+	info, err := os.Stat(real)
+	if err != nil || !info.IsDir() {
+		if err == nil {
+			err = fn(link, info)
+		}
+		return
+	}
+	follow := walker{symlinks: SymlinksFollow, scriptDir: filepath.Dir(s.scriptPath)}
+	return follow.walk(real, func(path string, info os.FileInfo) error {
+		rel, err := filepath.Rel(real, path)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.Join(link, rel), info)
+	})
+}
+
+// remove binaries that haven't been accessed for a while.
+// Check a file in each toolchain/platform variant directory to see when it was last touched (last run), so each
+// variant is retired independently.
+// Also remove any per-process build and cache directories that are older than cleanSecsBuildDirs, and unpacked
+// archives that haven't been used for a while
+func (s *Script) clean() (err error) {
+	perUserDir, err := os.Open(s.perUserTmpDir)
+	if err != nil {
+		return
+	}
+	infos, err := perUserDir.Readdir(-1)
+	if err != nil {
+		return
+	}
+	cutoffTime := time.Now().Add(time.Duration(-s.cleanSecs) * time.Second)
+	buildDirCutoffTime := time.Now().Add(time.Duration(-s.cleanSecsBuildDirs) * time.Second)
+
+	for _, info := range infos {
+		if info.IsDir() && info.Name() == archivesDir {
+			cleanArchives(filepath.Join(s.perUserTmpDir, info.Name()), cutoffTime, buildDirCutoffTime)
+		} else if info.IsDir() {
+			scriptDir := filepath.Join(s.perUserTmpDir, info.Name())
+
+			// binaries from before variant directories existed live directly in the script dir
+			st, err := os.Stat(filepath.Join(scriptDir, ".lastRun"))
+			if err == nil && st.ModTime().Before(cutoffTime) {
+				legacyBinaries, _ := filepath.Glob(filepath.Join(scriptDir, "*.bin"))
+				for _, legacy := range append(legacyBinaries, filepath.Join(scriptDir, ".lastRun")) {
+					_ = os.Remove(legacy)
+				}
+			}
+
+			entries, err := os.ReadDir(scriptDir)
+			if err != nil {
+				continue // Skip if we can't read the directory
+			}
+			for _, entry := range entries {
+				if !entry.IsDir() {
+					continue
+				}
+				if isBuildDir(entry.Name()) {
+					cleanBuildDir(filepath.Join(scriptDir, entry.Name()), buildDirCutoffTime)
+					continue
+				}
+				variantDir := filepath.Join(scriptDir, entry.Name())
+				// Check and clean the binary if it hasn't been accessed recently
+				st, err := os.Stat(filepath.Join(variantDir, ".lastRun"))
+				if err == nil && st.ModTime().Before(cutoffTime) {
+					makeRemovable(variantDir)
+					os.RemoveAll(variantDir)
+					continue // Directory removed, skip build dir cleanup
+				}
+				// Clean up old build directories (go build temporary directories left behind by crashes)
+				buildDirs, err := os.ReadDir(variantDir)
+				if err != nil {
+					continue
+				}
+				for _, buildDir := range buildDirs {
+					if buildDir.IsDir() && isBuildDir(buildDir.Name()) {
+						cleanBuildDir(filepath.Join(variantDir, buildDir.Name()), buildDirCutoffTime)
+					}
+				}
+			}
+			// only removes the script dir if every variant has gone
+			_ = os.Remove(scriptDir)
+		}
+	}
+	return nil
+}
+
+// isBuildDir reports whether a directory name is a per-process build directory (a PID, used by older versions of
+// gorun) or go build's GOTMPDIR
+func isBuildDir(name string) bool {
+	if _, err := strconv.Atoi(name); err == nil {
+		return true
+	}
+	return strings.HasPrefix(name, "go-build")
+}
+
+// cleanBuildDir removes a build directory if it is older than cutoffTime
+func cleanBuildDir(buildDirPath string, cutoffTime time.Time) {
+	buildDirInfo, err := os.Stat(buildDirPath)
+	if err == nil && buildDirInfo.ModTime().Before(cutoffTime) {
+		os.RemoveAll(buildDirPath)
+	}
+}
@@ -0,0 +1,89 @@
+package script
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeScript writes a script printing greeting, with an embedded go.mod, modified at modTime
+func writeScript(t *testing.T, path string, body string, modTime time.Time) {
+	t.Helper()
+	content := "package main\n\nimport \"fmt\"\n\nfunc main() {\n\t" + body + "\n}\n\n" +
+		"// go.mod >>>\n// :module hello\n// :\n// :go 1.24\n// <<< go.mod\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// needsGo skips a test that compiles a script if there's no go command
+func needsGo(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("no go command:", err)
+	}
+	t.Setenv("GOFLAGS", "")
+}
+
+func TestFallbackRunLeavesBrokenScriptOutOfDate(t *testing.T) {
+	needsGo(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hello.go")
+	opts := Options{TmpDirBase: t.TempDir()}
+	start := time.Now().Add(-time.Hour)
+
+	// compiles
+	writeScript(t, path, `fmt.Println("v1")`, start)
+	s, err := New(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Command(); err != nil {
+		t.Fatalf("first compile: %v", err)
+	}
+	binary, _ := s.Binary()
+	if err = os.Chtimes(binary, start, start); err != nil {
+		t.Fatal(err)
+	}
+
+	// broken, but still older than now, so touching the old binary would make it look up to date
+	broken := start.Add(time.Minute)
+	writeScript(t, path, `fmt.Println(undefined)`, broken)
+	fallbackOpts := opts
+	fallbackOpts.FallbackLastGood = true
+	s, err = New(path, fallbackOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := s.Command()
+	if err != nil {
+		t.Fatalf("fallback run: %v", err)
+	}
+	if out, err := cmd.Output(); err != nil || string(out) != "v1\n" {
+		t.Fatalf("fallback run: got %q, %v, want the last binary that compiled", out, err)
+	}
+	if info, err := os.Stat(binary); err != nil || info.ModTime().After(broken) {
+		t.Fatalf("fallback run touched the binary: %v %v", info.ModTime(), err)
+	}
+
+	// a normal run must still fail
+	s, err = New(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons, err := s.Explain()
+	if err != nil || len(reasons) == 0 {
+		t.Errorf("explain after a fallback run: got %q, %v, want out of date", reasons, err)
+	}
+	_, err = s.Command()
+	var buildErr *BuildError
+	if !errors.As(err, &buildErr) {
+		t.Fatalf("normal run after a fallback run: got %v, want a BuildError", err)
+	}
+}
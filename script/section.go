@@ -0,0 +1,362 @@
+package script
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"regexp"
+	"strings"
+)
+
+// Embedded sections are comments at the top of a script holding the contents of a file, e.g. go.mod:
+//
+//	// go.mod >>>
+//	// :module github.com/a/b
+//	// :go 1.24.0
+//	// <<< go.mod
+//
+// Each line is prefixed with ':' to stop gofmt reformatting it. Scripts written by older versions of gorun,
+// without the ':' prefix, are still read.
+//
+// Sections are checked strictly in the comments before the package clause, where gorun writes them. Further down,
+// only whole sections (a header and its trailer, with nothing but comment lines between) are used, so ordinary comments
+// in the code that happen to look like markers, e.g. '// a prompt like the python REPL >>>', are left alone.
+
+// commentSection turns the contents of a file in to a commented section, with the given header and trailer
+func commentSection(content []byte, header string, trailer string) (commented []byte) {
+	commented = bytes.ReplaceAll(content, []byte("\n"), []byte("\n// :"))
+	commented = append(commented, []byte("\n")...)
+	commented = append([]byte("// :"), commented...)
+	commented = append([]byte(header), commented...)
+	commented = append(commented, []byte(trailer)...)
+	return
+}
+
+// header transforms a section name, e.g. 'go.mod' in to a header comment, e.g. '// go.mod >>>\n'
+// with any encoding after the marker, e.g. '// assets.tar.gz >>> base64\n'
+func header(section string, encoding string) (header string) {
+	if encoding != "" {
+		return "// " + section + " >>> " + encoding + "\n"
+	}
+	return "// " + section + " >>>\n"
+}
+
+// trailer transforms a section name, e.g. 'go.mod' in to a trailer comment, e.g. '// <<< go.mod\n'
+func trailer(section string) (trailer string) {
+	return "// <<< " + section + "\n"
+}
+
+// BinfmtLine is the first line comment that binfmt_misc can be registered to run gorun for, see gorun-register.sh
+const BinfmtLine = "///bin/env gorun"
+
+// firstLineLen returns the length (including the newline) of a first line that must stay first, a shebang or the
+// binfmt comment, otherwise 0
+func firstLineLen(content []byte) int {
+	if !bytes.HasPrefix(content, []byte("#!")) && !bytes.HasPrefix(content, []byte(BinfmtLine)) {
+		return 0
+	}
+	if i := bytes.IndexByte(content, '\n'); i >= 0 {
+		return i + 1
+	}
+	return len(content)
+}
+
+// EmbedSection replaces a commented section of bytes with another commented section of bytes, returning the new
+// entire file contents. If the section isn't already there, it is added after the last of any previousSections found,
+// or at the very start of the file (after any shebang or binfmt first line). foundIdx is where the section was found, -1 if not found
+func EmbedSection(origContent []byte, sectionBytes []byte, section string, previousSections []string) (foundIdx int, content []byte) {
+	foundIdx, content, _ = EmbedEncodedSection(origContent, sectionBytes, section, "", previousSections)
+	return
+}
+
+// EmbedEncodedSection is EmbedSection for a section in the given encoding, e.g. EncodingBase64 for binary files.
+// An empty encoding embeds the text as is
+func EmbedEncodedSection(origContent []byte, sectionBytes []byte, section string, encoding string, previousSections []string) (foundIdx int, content []byte, err error) {
+	lines, err := encodeSection(sectionBytes, encoding)
+	if err != nil {
+		return -1, origContent, err
+	}
+	sectionBytes = []byte(strings.Join(lines, "\n"))
+	addNewline := false
+	// if we found the section, put the new one where the old one was
+	foundIdx, content = RemoveSection(origContent, section)
+	idx := foundIdx
+	if foundIdx < 0 { // if we failed to find the section, place it after any sections we want before it
+		idx = firstLineLen(content)
+		for _, prevSection := range previousSections {
+			found, _, _, _, foundIdx := SectionIndexes(content, prevSection)
+			if found && foundIdx > idx {
+				idx = foundIdx
+				addNewline = true
+			}
+		}
+	}
+	var contentStart, contentTrailer []byte
+
+	contentStart = append(contentStart, content[0:idx]...)
+	// only add a newline between sections go.sum and go.mod sections if we've added a new (e.g. go.sum) section
+	// after an existing section (e.g. go.mod), otherwise leave it as the user had it
+	if addNewline {
+		contentStart = append(contentStart, []byte("\n")...)
+	}
+	contentTrailer = append(contentTrailer, content[idx:]...)
+	content = append(contentStart, commentSection(sectionBytes, header(section, encoding), trailer(section))...)
+	content = append(content, contentTrailer...)
+	return
+}
+
+// Section is a commented section found in a script by ParseSections
+type Section struct {
+	Name          string // e.g. go.mod
+	Encoding      string // how the contents are encoded, e.g. EncodingBase64, empty for text
+	StartLine     int    // line number (from 1) of the header, e.g. '// go.mod >>>'
+	EndLine       int    // line number of the trailer, e.g. '// <<< go.mod'
+	StartIdx      int    // first byte of the header
+	InnerStartIdx int    // first byte of the line after the header
+	InnerEndIdx   int    // first byte of the trailer
+	EndIdx        int    // the byte after the trailer (and its newline)
+	Content       []byte // the contents with the comment prefixes removed
+}
+
+// ParseError is a problem found with the embedded sections of a script
+type ParseError struct {
+	Line    int // line number (from 1) in the script
+	Msg     string
+	Warning bool // only reported by Check, the script can still be built
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+var (
+	headerRe  = regexp.MustCompile(`^// ([^\s:]\S*) >>>(?: (\S+))?$`)
+	trailerRe = regexp.MustCompile(`^// <<< (\S+)$`)
+)
+
+// commentLines returns the numbers of the lines starting with a '//' comment, so that text that looks like a
+// section within a string literal or block comment is never mistaken for one, and the line of the package clause (0
+// if there isn't one, e.g. in a bundle manifest)
+func commentLines(content []byte) (lines map[int]bool, packageLine int) {
+	src := content
+	if bytes.HasPrefix(src, []byte("#!")) {
+		// a shebang isn't go, but is the same length as a comment
+		src = append([]byte("//"), src[2:]...)
+	}
+	lines = map[int]bool{}
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(src))
+	var sc scanner.Scanner
+	sc.Init(file, src, func(token.Position, string) {}, scanner.ScanComments)
+	for {
+		pos, tok, lit := sc.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok == token.PACKAGE && packageLine == 0 {
+			packageLine = file.Position(pos).Line
+		}
+		if tok == token.COMMENT && strings.HasPrefix(lit, "//") {
+			if position := file.Position(pos); position.Column == 1 {
+				lines[position.Line] = true
+			}
+		}
+	}
+	return
+}
+
+// ParseSections finds all the commented sections in a script. Any nested, duplicated or unterminated sections
+// before the package clause are reported as *ParseError (joined), and sections that could be parsed are still returned.
+// After the package clause, anything but a whole section is ignored
+func ParseSections(content []byte) (sections []Section, err error) {
+	var errs []error
+	fail := func(line int, format string, args ...any) {
+		errs = append(errs, &ParseError{Line: line, Msg: fmt.Sprintf(format, args...)})
+	}
+	comments, packageLine := commentLines(content)
+	seen := map[string]int{} // section name to the line it was first seen
+	var current *Section
+	var lines []string
+	// a section starting after the package clause is only used if it is whole, it may just be a comment
+	inCode := func() bool { return packageLine > 0 && current.StartLine > packageLine }
+
+	lineStart := 0
+	for lineNum := 1; lineStart < len(content); lineNum++ {
+		lineEnd := len(content)
+		nextLine := lineEnd
+		if i := bytes.IndexByte(content[lineStart:], '\n'); i >= 0 {
+			lineEnd = lineStart + i
+			nextLine = lineEnd + 1
+		}
+		line := strings.TrimRight(string(content[lineStart:lineEnd]), " \t\r")
+		isComment := comments[lineNum]
+		code := packageLine > 0 && lineNum > packageLine
+
+		header := headerRe.FindStringSubmatch(line)
+		if header != nil && code && !validEncoding(header[2]) {
+			header = nil
+		}
+		trailer := trailerRe.FindStringSubmatch(line)
+
+		switch {
+		case !isComment && current != nil:
+			if !inCode() {
+				fail(current.StartLine, "section %q is not terminated, expected '// <<< %s' before line %d",
+					current.Name, current.Name, lineNum)
+			}
+			current = nil
+		case !isComment:
+		case header != nil && current != nil && !inCode():
+			fail(lineNum, "section %q starts inside section %q (started on line %d)", header[1], current.Name, current.StartLine)
+		case header != nil:
+			if !code {
+				if first, ok := seen[header[1]]; ok {
+					fail(lineNum, "duplicate section %q, first on line %d", header[1], first)
+				} else {
+					seen[header[1]] = lineNum
+				}
+				if !validEncoding(header[2]) {
+					fail(lineNum, "section %q has unknown encoding %q, expected %s or %s",
+						header[1], header[2], EncodingBase64, EncodingGzipBase64)
+				}
+			}
+			current = &Section{Name: header[1], Encoding: header[2], StartLine: lineNum, StartIdx: lineStart, InnerStartIdx: nextLine}
+			lines = nil
+		case trailer != nil && current == nil:
+			if !code {
+				fail(lineNum, "end of section %q without a start '// %s >>>'", trailer[1], trailer[1])
+			}
+		case trailer != nil && trailer[1] != current.Name:
+			if !inCode() {
+				fail(lineNum, "end of section %q inside section %q (started on line %d)", trailer[1], current.Name, current.StartLine)
+			} else {
+				current = nil
+			}
+		case trailer != nil:
+			if inCode() {
+				if first, ok := seen[current.Name]; ok {
+					fail(current.StartLine, "duplicate section %q, first on line %d", current.Name, first)
+				} else {
+					seen[current.Name] = current.StartLine
+				}
+			}
+			current.EndLine = lineNum
+			current.InnerEndIdx = lineStart
+			current.EndIdx = nextLine
+			content, err := decodeSection(uncommentSection(lines), current.Encoding)
+			if err != nil {
+				fail(current.StartLine, "section %q can't be decoded: %v", current.Name, err)
+			} else if seen[current.Name] == current.StartLine {
+				current.Content = content
+				sections = append(sections, *current)
+			}
+			current = nil
+		case current != nil:
+			lines = append(lines, line)
+		}
+		lineStart = nextLine
+	}
+	if current != nil && !inCode() {
+		fail(current.StartLine, "section %q is not terminated, expected '// <<< %s'", current.Name, current.Name)
+	}
+	return sections, errors.Join(errs...)
+}
+
+// looseMarkers returns a warning for each comment before the package clause (outside any section) that looks like a
+// section marker but isn't one, e.g. '// go.mod>>>', which is most likely a mistake. They are reported by Check only
+func looseMarkers(content []byte, sections []Section) (warnings []error) {
+	comments, packageLine := commentLines(content)
+	inSection := func(lineNum int) bool {
+		for _, section := range sections {
+			if lineNum >= section.StartLine && lineNum <= section.EndLine {
+				return true
+			}
+		}
+		return false
+	}
+	for i, line := range strings.Split(string(content), "\n") {
+		lineNum := i + 1
+		if packageLine > 0 && lineNum >= packageLine {
+			break
+		}
+		line = strings.TrimRight(line, " \t\r")
+		if !comments[lineNum] || inSection(lineNum) || headerRe.MatchString(line) || trailerRe.MatchString(line) ||
+			strings.HasPrefix(line, "// :") {
+			continue
+		}
+		if strings.HasSuffix(line, ">>>") || strings.HasPrefix(strings.TrimLeft(line, "/ "), "<<<") {
+			warnings = append(warnings, &ParseError{Line: lineNum, Warning: true,
+				Msg: fmt.Sprintf("malformed section marker %q, expected '// name >>>' or '// <<< name'", line)})
+		}
+	}
+	return
+}
+
+// uncommentSection removes the comment prefixes from the lines of a section. Lines are written prefixed with
+// '// :', older versions of gorun only used '// '
+func uncommentSection(lines []string) (uncommented []string) {
+	colonFormat := false
+	for _, line := range lines {
+		if strings.HasPrefix(line, "// :") {
+			colonFormat = true
+			break
+		}
+	}
+	for _, line := range lines {
+		if colonFormat {
+			line = strings.TrimPrefix(line, "// :")
+		} else if line == "//" {
+			line = ""
+		} else {
+			line = strings.TrimPrefix(line, "// ")
+		}
+		uncommented = append(uncommented, line)
+	}
+	return
+}
+
+// findSection returns the first well formed section called sectionName
+func findSection(content []byte, sectionName string) (section Section, found bool) {
+	sections, _ := ParseSections(content)
+	for _, section = range sections {
+		if section.Name == sectionName {
+			return section, true
+		}
+	}
+	return Section{}, false
+}
+
+// SectionIndexes returns whether a section is found and if so, the indexes of start, end, etc.
+// found true iff a section called sectionName is found
+// startIdx is the first byte of the header for this section
+// endIdx is the byte after the trailer for this section.
+// InnerIdx mark the start and end of the real content for this section
+func SectionIndexes(content []byte, sectionName string) (found bool, startIdx int, startInnerIdx int, endInnerIdx int, endIdx int) {
+	section, found := findSection(content, sectionName)
+	if !found {
+		return false, -1, -1, -1, -1
+	}
+	return true, section.StartIdx, section.InnerStartIdx, section.InnerEndIdx, section.EndIdx
+}
+
+// GetSection finds, removes comments, and returns the comment section embedded in a file, or empty if not found
+func GetSection(content []byte, sectionName string) (section []byte) {
+	if found, ok := findSection(content, sectionName); ok {
+		return found.Content
+	}
+	return []byte("")
+}
+
+// RemoveSection removes a commented section from the contents of the entire file, returning the new contents and where it was removed from
+func RemoveSection(content []byte, sectionName string) (startIdx int, newContent []byte) {
+	found, startIdx, _, _, endIdx := SectionIndexes(content, sectionName)
+	if found {
+		newContent = append([]byte{}, content[0:startIdx]...)
+		newContent = append(newContent, content[endIdx:]...)
+	} else {
+		newContent = content
+	}
+	return
+}
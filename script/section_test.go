@@ -0,0 +1,250 @@
+package script
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// parseErrorLines returns the lines of the joined *ParseError in err
+func parseErrorLines(t *testing.T, err error) (lines []int) {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		t.Fatalf("expected joined errors, got %T %v", err, err)
+	}
+	for _, e := range joined.Unwrap() {
+		var parseErr *ParseError
+		if !errors.As(e, &parseErr) {
+			t.Fatalf("expected a *ParseError, got %T %v", e, e)
+		}
+		lines = append(lines, parseErr.Line)
+	}
+	return
+}
+
+func TestParseSections(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    string
+		want       map[string]string // section name to contents
+		wantErrors []int             // lines of the errors reported
+	}{{
+		name:    "colon format",
+		content: "// go.mod >>>\n// :module a\n// :\n// :go 1.24\n// <<< go.mod\n\npackage main\n",
+		want:    map[string]string{"go.mod": "module a\n\ngo 1.24\n"},
+	}, {
+		name:    "legacy format without the colon",
+		content: "// go.mod >>>\n// module a\n//\n// go 1.24\n// <<< go.mod\npackage main\n",
+		want:    map[string]string{"go.mod": "module a\n\ngo 1.24\n"},
+	}, {
+		name:    "after a shebang",
+		content: "#!/usr/bin/env gorun\n// go.env >>>\n// :CGO_ENABLED=0\n// <<< go.env\npackage main\n",
+		want:    map[string]string{"go.env": "CGO_ENABLED=0\n"},
+	}, {
+		name:    "several sections",
+		content: "// go.mod >>>\n// :module a\n// <<< go.mod\n\n// go.env >>>\n// :A=1\n// <<< go.env\npackage main\n",
+		want:    map[string]string{"go.mod": "module a\n", "go.env": "A=1\n"},
+	}, {
+		name:    "empty section",
+		content: "// go.sum >>>\n// <<< go.sum\npackage main\n",
+		want:    map[string]string{"go.sum": ""},
+	}, {
+		name:    "base64 encoded",
+		content: "// data.bin >>> base64\n// :AAEC\n// <<< data.bin\npackage main\n",
+		want:    map[string]string{"data.bin": "\x00\x01\x02"},
+	}, {
+		name:       "unknown encoding",
+		content:    "// data.bin >>> rot13\n// :abc\n// <<< data.bin\npackage main\n",
+		want:       map[string]string{},
+		wantErrors: []int{1, 1},
+	}, {
+		name:       "nested",
+		content:    "// go.mod >>>\n// :module a\n// go.sum >>>\n// <<< go.sum\n// <<< go.mod\npackage main\n",
+		want:       map[string]string{"go.mod": "module a\n"},
+		wantErrors: []int{3, 4},
+	}, {
+		name:       "duplicate, the first is used",
+		content:    "// go.env >>>\n// :A=1\n// <<< go.env\n// go.env >>>\n// :A=2\n// <<< go.env\npackage main\n",
+		want:       map[string]string{"go.env": "A=1\n"},
+		wantErrors: []int{4},
+	}, {
+		name:       "unterminated before code",
+		content:    "// go.mod >>>\n// :module a\npackage main\n",
+		want:       map[string]string{},
+		wantErrors: []int{1},
+	}, {
+		name:       "unterminated at the end of a bundle manifest",
+		content:    "// go.mod >>>\n// :module a\n",
+		want:       map[string]string{},
+		wantErrors: []int{1},
+	}, {
+		name:       "trailer without a header",
+		content:    "// <<< go.mod\npackage main\n",
+		want:       map[string]string{},
+		wantErrors: []int{1},
+	}, {
+		name:       "mismatched trailer",
+		content:    "// go.mod >>>\n// <<< go.sum\n// <<< go.mod\npackage main\n",
+		want:       map[string]string{"go.mod": ""},
+		wantErrors: []int{2},
+	}, {
+		name:    "in a string literal",
+		content: "package main\n\nvar s = `\n// go.mod >>>\n// :module a\n// <<< go.mod\n`\n",
+		want:    map[string]string{},
+	}, {
+		name:    "in a block comment",
+		content: "/*\n// go.mod >>>\n// :module a\n// <<< go.mod\n*/\npackage main\n",
+		want:    map[string]string{},
+	}, {
+		name:    "comments in the code that look like markers",
+		content: "package main\n\n// Prints a prompt like the python REPL >>>\n// REPL >>>\nfunc main() {}\n// <<< done\n// go.mod >>>\n",
+		want:    map[string]string{},
+	}, {
+		name:    "whole section in the code",
+		content: "package main\n\nfunc main() {}\n\n// go.mod >>>\n// :module a\n// <<< go.mod\n",
+		want:    map[string]string{"go.mod": "module a\n"},
+	}, {
+		name:    "nested in the code, the inner section is used",
+		content: "package main\n\n// docs >>>\n// go.mod >>>\n// :module a\n// <<< go.mod\n",
+		want:    map[string]string{"go.mod": "module a\n"},
+	}, {
+		name:       "duplicated in the code",
+		content:    "// go.mod >>>\n// :module a\n// <<< go.mod\npackage main\n\n// go.mod >>>\n// :module b\n// <<< go.mod\n",
+		want:       map[string]string{"go.mod": "module a\n"},
+		wantErrors: []int{6},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sections, err := ParseSections([]byte(tt.content))
+			if got := parseErrorLines(t, err); !reflect.DeepEqual(got, tt.wantErrors) {
+				t.Errorf("error lines: got %v, want %v (%v)", got, tt.wantErrors, err)
+			}
+			got := map[string]string{}
+			for _, section := range sections {
+				got[section.Name] = string(section.Content)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sections: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSectionsIndexes(t *testing.T) {
+	content := "#!/usr/bin/env gorun\n// go.mod >>>\n// :module a\n// <<< go.mod\npackage main\n"
+	sections, err := ParseSections([]byte(content))
+	if err != nil || len(sections) != 1 {
+		t.Fatalf("got %v, %v", sections, err)
+	}
+	s := sections[0]
+	if s.StartLine != 2 || s.EndLine != 4 {
+		t.Errorf("lines: got %d-%d, want 2-4", s.StartLine, s.EndLine)
+	}
+	if got := content[s.StartIdx:s.EndIdx]; got != "// go.mod >>>\n// :module a\n// <<< go.mod\n" {
+		t.Errorf("whole section: got %q", got)
+	}
+	if got := content[s.InnerStartIdx:s.InnerEndIdx]; got != "// :module a\n" {
+		t.Errorf("inner section: got %q", got)
+	}
+}
+
+func TestLooseMarkers(t *testing.T) {
+	content := "// go.mod>>>\n// go.mod >>>\n// :x >>>\n// <<< go.mod\n//<<< go.sum\n\npackage main\n\n// REPL>>>\n"
+	sections, err := ParseSections([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []int
+	for _, warning := range looseMarkers([]byte(content), sections) {
+		var parseErr *ParseError
+		if !errors.As(warning, &parseErr) || !parseErr.Warning {
+			t.Fatalf("expected a warning, got %v", warning)
+		}
+		lines = append(lines, parseErr.Line)
+	}
+	// not the section's contents, nor anything after the package clause
+	if want := []int{1, 5}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("got warnings on lines %v, want %v", lines, want)
+	}
+}
+
+func TestEmbedSection(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		section   string
+		embed     string
+		previous  []string
+		want      string
+		wantFound bool
+	}{{
+		name:    "at the start",
+		content: "package main\n",
+		section: "go.mod",
+		embed:   "module a",
+		want:    "// go.mod >>>\n// :module a\n// <<< go.mod\npackage main\n",
+	}, {
+		name:    "after a shebang",
+		content: "#!/usr/bin/env gorun\npackage main\n",
+		section: "go.mod",
+		embed:   "module a",
+		want:    "#!/usr/bin/env gorun\n// go.mod >>>\n// :module a\n// <<< go.mod\npackage main\n",
+	}, {
+		name:    "after a binfmt line",
+		content: BinfmtLine + "\npackage main\n",
+		section: "go.mod",
+		embed:   "module a",
+		want:    BinfmtLine + "\n// go.mod >>>\n// :module a\n// <<< go.mod\npackage main\n",
+	}, {
+		name:      "replaced where it was",
+		content:   "// comment\n// go.mod >>>\n// :module a\n// <<< go.mod\n// after\npackage main\n",
+		section:   "go.mod",
+		embed:     "module b\n\ngo 1.24",
+		want:      "// comment\n// go.mod >>>\n// :module b\n// :\n// :go 1.24\n// <<< go.mod\n// after\npackage main\n",
+		wantFound: true,
+	}, {
+		name:     "after the previous sections",
+		content:  "// go.mod >>>\n// :module a\n// <<< go.mod\npackage main\n",
+		section:  "go.sum",
+		embed:    "a v1 h1:x",
+		previous: []string{"go.mod"},
+		want:     "// go.mod >>>\n// :module a\n// <<< go.mod\n\n// go.sum >>>\n// :a v1 h1:x\n// <<< go.sum\npackage main\n",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			foundIdx, got := EmbedSection([]byte(tt.content), []byte(tt.embed), tt.section, tt.previous)
+			if string(got) != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+			if found := foundIdx >= 0; found != tt.wantFound {
+				t.Errorf("found: got %v (%d), want %v", found, foundIdx, tt.wantFound)
+			}
+			// text is returned with a trailing newline, as a file
+			if section := GetSection(got, tt.section); string(section) != tt.embed+"\n" {
+				t.Errorf("round trip: got %q, want %q", section, tt.embed)
+			}
+		})
+	}
+}
+
+func TestEmbedEncodedSectionRoundTrips(t *testing.T) {
+	binary := []byte(strings.Repeat("\x00\x01\xff gorun ", 40))
+	for _, encoding := range []string{EncodingBase64, EncodingGzipBase64} {
+		_, content, err := EmbedEncodedSection([]byte("package main\n"), binary, "data.bin", encoding, nil)
+		if err != nil {
+			t.Fatalf("%v: %v", encoding, err)
+		}
+		sections, err := ParseSections(content)
+		if err != nil || len(sections) != 1 {
+			t.Fatalf("%v: got %v, %v", encoding, sections, err)
+		}
+		if sections[0].Encoding != encoding || string(sections[0].Content) != string(binary) {
+			t.Errorf("%v: got %q encoded %q", encoding, sections[0].Content, sections[0].Encoding)
+		}
+	}
+}
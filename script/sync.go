@@ -0,0 +1,164 @@
+package script
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// syncTree incrementally updates a persistent build tree. Files are only rewritten if their contents or mode
+// changed, and anything in the tree not written or copied during this sync is removed by prune
+type syncTree struct {
+	root   string
+	walker walker          // how source directories are walked, e.g. whether symlinks are followed
+	keep   map[string]bool // paths written or copied this sync, and their parent directories
+}
+
+func newSyncTree(root string, w walker) *syncTree {
+	return &syncTree{root: root, walker: w, keep: map[string]bool{}}
+}
+
+// mark records that path (and every directory above it, up to the root) is part of the tree
+func (t *syncTree) mark(path string) {
+	for ; !t.keep[path]; path = filepath.Dir(path) {
+		t.keep[path] = true
+		if path == t.root || path == filepath.Dir(path) {
+			break
+		}
+	}
+}
+
+// writeFile writes content to path, unless it already holds exactly that content with that mode
+func (t *syncTree) writeFile(path string, content []byte, mode os.FileMode) (err error) {
+	t.mark(path)
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().IsRegular() && info.Size() == int64(len(content)) && info.Mode().Perm() == mode.Perm() {
+			existing, err := os.ReadFile(path)
+			if err == nil && bytes.Equal(existing, content) {
+				return nil
+			}
+		}
+		if !info.Mode().IsRegular() {
+			if err = os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return
+	}
+	if err = os.WriteFile(path, content, mode); err != nil {
+		return
+	}
+	return os.Chmod(path, mode) // WriteFile leaves the mode of an existing file alone
+}
+
+// copyDir copies the directory srcDir to dstDir, only copying files that differ in size or content (by hash), and
+// keeping file modes. Symlinks are recreated or followed according to the walker's policy
+func (t *syncTree) copyDir(dstDir string, srcDir string) (err error) {
+	return t.walker.walk(srcDir, func(srcPath string, f os.FileInfo) error {
+		relPath, err := filepath.Rel(srcDir, srcPath)
+		if err != nil {
+			return err
+		}
+		dstPath := filepath.Join(dstDir, relPath)
+		switch {
+		case f.IsDir():
+			t.mark(dstPath)
+			if info, err := os.Lstat(dstPath); err == nil && !info.IsDir() {
+				_ = os.Remove(dstPath)
+			}
+			return os.MkdirAll(dstPath, 0700)
+		case f.Mode()&os.ModeSymlink != 0:
+			if err = t.copySymlink(dstPath, srcPath); err != nil {
+				return fmt.Errorf("failed to copy symlink %s: %w", t.walker.rel(srcPath), err)
+			}
+		default:
+			if err = t.copyFile(dstPath, srcPath, f); err != nil {
+				return fmt.Errorf("failed to copy %s: %w", t.walker.rel(srcPath), err)
+			}
+		}
+		return nil
+	})
+}
+
+// copyFile copies a regular file if the destination differs in size, mode or content
+func (t *syncTree) copyFile(dstPath string, srcPath string, src os.FileInfo) (err error) {
+	t.mark(dstPath)
+	mode := src.Mode().Perm() | 0600 // we must be able to rewrite it next time
+	if dst, err := os.Lstat(dstPath); err == nil && dst.Mode().IsRegular() && dst.Size() == src.Size() &&
+		dst.Mode().Perm() == mode {
+		srcHash, srcErr := fileHash(srcPath)
+		dstHash, dstErr := fileHash(dstPath)
+		if srcErr == nil && dstErr == nil && srcHash == dstHash {
+			return nil
+		}
+	}
+	content, err := os.ReadFile(srcPath)
+	if err != nil {
+		return
+	}
+	return t.writeFile(dstPath, content, mode)
+}
+
+// copySymlink recreates a symlink, unless it already points at the same place
+func (t *syncTree) copySymlink(dstPath string, srcPath string) (err error) {
+	t.mark(dstPath)
+	target, err := os.Readlink(srcPath)
+	if err != nil {
+		return
+	}
+	if existing, err := os.Readlink(dstPath); err == nil && existing == target {
+		return nil
+	}
+	if err = os.RemoveAll(dstPath); err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(dstPath), 0700); err != nil {
+		return
+	}
+	return os.Symlink(target, dstPath)
+}
+
+// prune removes everything in the tree that wasn't written or copied during this sync, e.g. deleted source files
+func (t *syncTree) prune() (removed []string, err error) {
+	err = filepath.Walk(t.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if t.keep[path] {
+			return nil
+		}
+		makeRemovable(path)
+		if err = os.RemoveAll(path); err != nil {
+			return err
+		}
+		removed = append(removed, path)
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return
+}
+
+// fileHash returns the sha256 of a file's contents
+func fileHash(path string) (hash [sha256.Size]byte, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return
+	}
+	copy(hash[:], h.Sum(nil))
+	return
+}
@@ -0,0 +1,138 @@
+package script
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// listTree returns the paths under root, relative to it, with a trailing '/' for a directory and '@' and the target
+// for a symlink
+func listTree(t *testing.T, root string) (paths []string) {
+	t.Helper()
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		rel = filepath.ToSlash(rel)
+		switch {
+		case info.IsDir():
+			rel += "/"
+		case info.Mode()&os.ModeSymlink != 0:
+			target, _ := os.Readlink(path)
+			rel += "@" + target
+		}
+		paths = append(paths, rel)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestSyncTreePrune(t *testing.T) {
+	tests := []struct {
+		name        string
+		before      []string
+		after       []string
+		symlinks    [2]map[string]string // before and after
+		want        []string
+		wantRemoved []string
+	}{{
+		name:   "unchanged",
+		before: []string{"a.go", "sub/b.go"},
+		after:  []string{"a.go", "sub/b.go"},
+		want:   []string{"a.go", "go.mod", "sub/", "sub/b.go"},
+	}, {
+		name:        "deleted file",
+		before:      []string{"a.go", "sub/b.go"},
+		after:       []string{"a.go", "sub/"},
+		want:        []string{"a.go", "go.mod", "sub/"},
+		wantRemoved: []string{"sub/b.go"},
+	}, {
+		name:        "deleted directory",
+		before:      []string{"a.go", "sub/deeper/b.go"},
+		after:       []string{"a.go"},
+		want:        []string{"a.go", "go.mod"},
+		wantRemoved: []string{"sub"},
+	}, {
+		name:   "file replaced by a directory",
+		before: []string{"a.go", "x"},
+		after:  []string{"a.go", "x/y.go"},
+		want:   []string{"a.go", "go.mod", "x/", "x/y.go"},
+	}, {
+		name:   "directory replaced by a file",
+		before: []string{"a.go", "x/y.go"},
+		after:  []string{"a.go", "x"},
+		want:   []string{"a.go", "go.mod", "x"},
+	}, {
+		name:     "symlink retargeted",
+		before:   []string{"a.go", "b.go"},
+		after:    []string{"a.go", "b.go"},
+		symlinks: [2]map[string]string{{"l.go": "a.go"}, {"l.go": "b.go"}},
+		want:     []string{"a.go", "b.go", "go.mod", "l.go@b.go"},
+	}, {
+		name:        "symlink deleted",
+		before:      []string{"a.go"},
+		after:       []string{"a.go"},
+		symlinks:    [2]map[string]string{{"l.go": "a.go"}, nil},
+		want:        []string{"a.go", "go.mod"},
+		wantRemoved: []string{"l.go"},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			dst := filepath.Join(dir, "tree")
+			sync := func(files []string, symlinks map[string]string) (removed []string) {
+				src := filepath.Join(dir, "src")
+				if err := os.RemoveAll(src); err != nil {
+					t.Fatal(err)
+				}
+				makeTree(t, src, files, symlinks)
+				tree := newSyncTree(dst, walker{symlinks: SymlinksRecreate, scriptDir: src, copied: []string{src}})
+				tree.mark(dst)
+				if err := tree.copyDir(dst, src); err != nil {
+					t.Fatal(err)
+				}
+				if err := tree.writeFile(filepath.Join(dst, "go.mod"), []byte("module hello\n"), 0600); err != nil {
+					t.Fatal(err)
+				}
+				paths, err := tree.prune()
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, path := range paths {
+					rel, _ := filepath.Rel(dst, path)
+					removed = append(removed, filepath.ToSlash(rel))
+				}
+				sort.Strings(removed)
+				return
+			}
+			sync(tt.before, tt.symlinks[0])
+			// files left as they were aren't rewritten
+			old := time.Now().Add(-time.Hour).Truncate(time.Second)
+			for _, name := range []string{"a.go", "go.mod"} {
+				if err := os.Chtimes(filepath.Join(dst, name), old, old); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if removed := sync(tt.after, tt.symlinks[1]); !reflect.DeepEqual(removed, tt.wantRemoved) {
+				t.Errorf("removed %q, want %q", removed, tt.wantRemoved)
+			}
+			if got := listTree(t, dst); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			for _, name := range []string{"a.go", "go.mod"} {
+				if info, err := os.Stat(filepath.Join(dst, name)); err != nil || !info.ModTime().Equal(old) {
+					t.Errorf("%v rewritten: %v", name, err)
+				}
+			}
+		})
+	}
+}
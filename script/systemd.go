@@ -0,0 +1,149 @@
+package script
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SYSTEMD is the section holding extra directives for the unit written by SystemdUnit, e.g. hardening. They go in
+// the [Service] section unless a '[Unit]' or '[Install]' line comes first, e.g.
+//
+//	// gorun.systemd >>>
+//	// :NoNewPrivileges=yes
+//	// :ProtectSystem=strict
+//	// :ProtectHome=yes
+//	// :[Unit]
+//	// :Documentation=https://example.com/myserver
+//	// <<< gorun.systemd
+const SYSTEMD = "gorun.systemd"
+
+// UnitOptions configures the unit written by SystemdUnit
+type UnitOptions struct {
+	Gorun       string   // full path to the gorun binary
+	GorunArgs   []string // options for gorun, passed in GORUN_ARGS
+	Args        []string // arguments for the script
+	User        string   // user the script runs as, a transient user (systemd's DynamicUser) if empty
+	Description string   // the script path if empty
+}
+
+// systemdSections are the unit sections the SYSTEMD section can add directives to
+var systemdSections = []string{"[Unit]", "[Install]", "[Service]"}
+
+// SystemdUnit returns a systemd service unit running the script with gorun. The script is compiled by ExecStartPre
+// (with -noRun), so a compile error fails the start with the compiler's output in the journal. gorun's files, the go
+// build and module caches are kept in the service's CacheDirectory, so dependencies are downloaded once rather than
+// for every compile, even by a user without a home directory. Any directives in the script's SYSTEMD section are added
+func (s *Script) SystemdUnit(opts UnitOptions) (unit []byte, err error) {
+	content, err := os.ReadFile(s.scriptPath)
+	if err != nil {
+		return
+	}
+	extra, err := systemdDirectives(GetSection(content, SYSTEMD))
+	if err != nil {
+		return
+	}
+	if opts.Description == "" {
+		opts.Description = "gorun " + s.scriptPath
+	}
+	// unit names are made of a limited set of characters
+	name := "gorun-" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.", r) {
+			return r
+		}
+		return '_'
+	}, strings.TrimSuffix(filepath.Base(s.scriptPath), ".go"))
+	// %C is the CacheDirectory's parent, e.g. /var/cache
+	gorunArgs := []string{"-targetDirBase", "%C/" + name}
+	prebuild := "ExecStartPre="
+	for _, arg := range opts.GorunArgs {
+		gorunArgs = append(gorunArgs, systemdEscape(arg, false))
+		switch arg {
+		case "-fallbackLastGood", "--fallbackLastGood", "-fallbackLastGood=true", "--fallbackLastGood=true":
+			// a failed compile mustn't stop the last binary that compiled being started
+			prebuild = "ExecStartPre=-"
+		}
+	}
+	gorun := systemdQuote(systemdEscape(opts.Gorun, true))
+	script := systemdQuote(systemdEscape(s.scriptPath, true))
+
+	var b bytes.Buffer
+	_, _ = fmt.Fprintf(&b, "# written by: gorun systemd-unit %v\n", s.scriptPath)
+	_, _ = fmt.Fprintf(&b, "[Unit]\nDescription=%v\nAfter=network-online.target\nWants=network-online.target\n",
+		opts.Description)
+	writeDirectives(&b, extra["[Unit]"])
+	_, _ = fmt.Fprintf(&b, "\n[Service]\nType=simple\n")
+	if opts.User != "" {
+		_, _ = fmt.Fprintf(&b, "User=%v\n", opts.User)
+	} else {
+		_, _ = fmt.Fprintf(&b, "DynamicUser=yes\n")
+	}
+	_, _ = fmt.Fprintf(&b, "CacheDirectory=%v\n", name)
+	_, _ = fmt.Fprintf(&b, "# a HOME that exists, so modules are downloaded once rather than for every compile\n")
+	_, _ = fmt.Fprintf(&b, "Environment=HOME=%%C/%v GOCACHE=%%C/%v/go-build\n", name, name)
+	_, _ = fmt.Fprintf(&b, "Environment=%v\n", systemdQuote("GORUN_ARGS="+strings.Join(gorunArgs, " ")))
+	_, _ = fmt.Fprintf(&b, "# compile first, so a broken script fails to start with the compiler's output in the journal\n")
+	_, _ = fmt.Fprintf(&b, "%v%v -noRun %v\n", prebuild, gorun, script)
+	_, _ = fmt.Fprintf(&b, "ExecStart=%v %v", gorun, script)
+	for _, arg := range opts.Args {
+		_, _ = fmt.Fprintf(&b, " %v", systemdQuote(systemdEscape(arg, true)))
+	}
+	_, _ = fmt.Fprintf(&b, "\n# compiling, and downloading modules, can take a while\nTimeoutStartSec=300\nRestart=on-failure\n")
+	writeDirectives(&b, extra["[Service]"])
+	_, _ = fmt.Fprintf(&b, "\n[Install]\nWantedBy=multi-user.target\n")
+	writeDirectives(&b, extra["[Install]"])
+	return b.Bytes(), nil
+}
+
+// systemdDirectives splits the SYSTEMD section in to the directives for each unit section, [Service] by default
+func systemdDirectives(section []byte) (directives map[string][]string, err error) {
+	directives = map[string][]string{}
+	current := "[Service]"
+	for _, line := range strings.Split(string(section), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "["):
+			found := false
+			for _, name := range systemdSections {
+				found = found || line == name
+			}
+			if !found {
+				return nil, fmt.Errorf("%v: unknown unit section %v, expected one of %v", SYSTEMD, line,
+					strings.Join(systemdSections, ", "))
+			}
+			current = line
+		case !strings.Contains(line, "="):
+			return nil, fmt.Errorf("%v: expected 'Directive=value', got %q", SYSTEMD, line)
+		default:
+			directives[current] = append(directives[current], line)
+		}
+	}
+	return
+}
+
+func writeDirectives(b *bytes.Buffer, directives []string) {
+	for _, directive := range directives {
+		_, _ = fmt.Fprintln(b, directive)
+	}
+}
+
+// systemdEscape escapes a value for a unit file: '%' so it isn't taken as a specifier, '\' and '"' for quoting, and
+// '$' in command lines, where it would otherwise be expanded as a variable
+func systemdEscape(value string, command bool) string {
+	escaped := strings.NewReplacer(`%`, `%%`, `\`, `\\`, `"`, `\"`).Replace(value)
+	if command {
+		escaped = strings.ReplaceAll(escaped, "$", "$$")
+	}
+	return escaped
+}
+
+// systemdQuote double quotes an escaped value if it is empty or has any whitespace, quotes or escapes in it
+func systemdQuote(escaped string) string {
+	if escaped != "" && !strings.ContainsAny(escaped, " \t'\"\\") {
+		return escaped
+	}
+	return `"` + escaped + `"`
+}
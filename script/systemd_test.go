@@ -0,0 +1,142 @@
+package script
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestSystemdQuote(t *testing.T) {
+	tests := []struct {
+		value   string
+		command bool
+		want    string
+	}{
+		{"/usr/local/bin/gorun", true, "/usr/local/bin/gorun"},
+		{"", true, `""`},
+		{"a b", true, `"a b"`},
+		{"tab\there", true, "\"tab\there\""},
+		{"100%", true, "100%%"},
+		{"$HOME", true, "$$HOME"},
+		{"$HOME", false, "$HOME"},
+		{`say "hi"`, true, `"say \"hi\""`},
+		{`it's`, true, `"it's"`},
+		{`C:\gorun`, true, `"C:\\gorun"`},
+	}
+	for _, tt := range tests {
+		if got := systemdQuote(systemdEscape(tt.value, tt.command)); got != tt.want {
+			t.Errorf("%q (command %v): got %v, want %v", tt.value, tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestSystemdDirectives(t *testing.T) {
+	tests := []struct {
+		name    string
+		section string
+		want    map[string][]string
+		wantErr string
+	}{
+		{"none", "", map[string][]string{}, ""},
+		{"service by default", "NoNewPrivileges=yes\n# comment\n; comment\n\n  ProtectHome=yes  ",
+			map[string][]string{"[Service]": {"NoNewPrivileges=yes", "ProtectHome=yes"}}, ""},
+		{"sections", "[Unit]\nDocumentation=https://example.com\n[Install]\nAlias=x.service\n[Service]\nNice=5",
+			map[string][]string{"[Unit]": {"Documentation=https://example.com"}, "[Install]": {"Alias=x.service"}, "[Service]": {"Nice=5"}}, ""},
+		{"unknown section", "[Timer]\nOnCalendar=daily", nil, "unknown unit section [Timer]"},
+		{"not a directive", "NoNewPrivileges", nil, "expected 'Directive=value'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := systemdDirectives([]byte(tt.section))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSystemdUnit(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the script path would be escaped, and systemd is for linux")
+	}
+	dir := filepath.Join(t.TempDir(), "my scripts")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "web server.go")
+	content := "// gorun.systemd >>>\n// :ProtectHome=yes\n// :[Install]\n// :Alias=web.service\n// <<< gorun.systemd\n" +
+		"package main\n\nfunc main() {}\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		opts UnitOptions
+		want []string // lines in the unit
+	}{{
+		name: "defaults",
+		opts: UnitOptions{Gorun: "/usr/local/bin/gorun"},
+		want: []string{
+			"Description=gorun " + path,
+			"DynamicUser=yes",
+			"CacheDirectory=gorun-web_server",
+			`Environment="GORUN_ARGS=-targetDirBase %C/gorun-web_server"`,
+			`ExecStartPre=/usr/local/bin/gorun -noRun "` + path + `"`,
+			`ExecStart=/usr/local/bin/gorun "` + path + `"`,
+			"ProtectHome=yes",
+			"Alias=web.service",
+		},
+	}, {
+		name: "arguments",
+		opts: UnitOptions{
+			Gorun:     "/opt/go run/gorun",
+			GorunArgs: []string{"-fallbackLastGood", "-logLevel=debug"},
+			Args:      []string{"-listen", ":8080", "$PORT", "50%", `a "b"`},
+			User:      "www",
+		},
+		want: []string{
+			"User=www",
+			`Environment="GORUN_ARGS=-targetDirBase %C/gorun-web_server -fallbackLastGood -logLevel=debug"`,
+			`ExecStartPre=-"/opt/go run/gorun" -noRun "` + path + `"`,
+			`ExecStart="/opt/go run/gorun" "` + path + `" -listen :8080 $$PORT 50%% "a \"b\""`,
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unit, err := s.SystemdUnit(tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(string(unit), "\n")
+			for _, want := range tt.want {
+				found := false
+				for _, line := range lines {
+					found = found || line == want
+				}
+				if !found {
+					t.Errorf("no line %v in:\n%s", want, unit)
+				}
+			}
+			// the [Install] directive is after the [Install] header
+			if strings.Index(string(unit), "Alias=") < strings.Index(string(unit), "[Install]") {
+				t.Errorf("Alias in the wrong section:\n%s", unit)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package script
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Tidy runs 'go mod tidy' on the script laid out in its build tree (including any go.work libraries),
+// then embeds the resulting go.mod and go.sum back in to the script. No go.mod/go.sum files are left beside the
+// script. changed reports whether the script was rewritten
+func (s *Script) Tidy() (changed bool, err error) {
+	_, _, changed, err = s.updateModules([]string{"mod", "tidy"})
+	return
+}
+
+// updateModules lays the script out in its build tree, runs each of the go commands there in turn, and
+// embeds the updated go.mod and go.sum back in to the script (or its bundle manifest), only writing it if they
+// changed. It returns the go.mod contents from before and after
+func (s *Script) updateModules(goCommands ...[]string) (oldMod []byte, newMod []byte, changed bool, err error) {
+	err = s.initVars()
+	if err != nil {
+		return
+	}
+	// the module files are written back to the bundle manifest, if the script uses one
+	target := s.scriptPath
+	if s.bundlePath != "" {
+		target = s.bundlePath
+	}
+	content, err := os.ReadFile(target)
+	if err != nil {
+		return
+	}
+	if _, err = ParseSections(content); err != nil {
+		return nil, nil, false, fmt.Errorf("not updating malformed sections, see gorun -check: %w", err)
+	}
+
+	unlock, err := s.lockBuildTree()
+	if err != nil {
+		return
+	}
+	defer unlock()
+	err = s.updateTarget()
+	if err != nil {
+		return
+	}
+	if s.bundlePath != "" {
+		err = s.updateBundleTarget()
+		if err != nil {
+			return
+		}
+	}
+
+	gobin, err := s.goBinary()
+	if err != nil {
+		return
+	}
+	env := s.goCommandEnv()
+	for _, args := range goCommands {
+		s.log.Info("running go command", "script", s.scriptPath, "dir", s.buildTreeDir, "args", args)
+		mapped := s.mapOutputPaths(s.buildOutput)
+		err = runCommand(s.buildTreeDir, env, mapped, gobin, args...)
+		_ = mapped.Flush()
+		if err != nil {
+			return
+		}
+	}
+
+	oldMod, err = s.goModContent()
+	if err != nil {
+		return
+	}
+	newContent, err := s.embedUpdatedModule(content)
+	if err != nil {
+		return
+	}
+	newMod = GetSection(newContent, GOMOD)
+	if bytes.Equal(content, newContent) {
+		return oldMod, newMod, false, nil
+	}
+	err = os.WriteFile(target, newContent, 0600)
+	return oldMod, newMod, err == nil, err
+}
+
+// embedUpdatedModule embeds the go.mod and go.sum written by the go command in the build tree in to content. A go.sum
+// section is removed if the go command removed go.sum, e.g. as there are no longer any dependencies. Paths pointed at
+// the build tree by rewriteAbsPaths are pointed back at the originals
+func (s *Script) embedUpdatedModule(content []byte) (newContent []byte, err error) {
+	dir, buildRoot := s.buildTreeDir, s.buildTreeBase
+	foundMod, modContent, err := loadFile(filepath.Join(dir, GOMOD))
+	if err != nil {
+		return
+	}
+	if !foundMod {
+		return nil, fmt.Errorf("no %v written by the go command in %v", GOMOD, dir)
+	}
+	foundSum, sumContent, err := loadFile(filepath.Join(dir, GOSUM))
+	if err != nil {
+		return
+	}
+
+	if modContent, err = s.restoreBundlePaths(modContent); err != nil {
+		return
+	}
+	modContent = bytes.ReplaceAll(modContent, []byte(buildRoot+string(filepath.Separator)), []byte(string(filepath.Separator)))
+	_, content = EmbedSection(content, modContent, GOMOD, []string{})
+	if foundSum && len(sumContent) > 0 {
+		_, content = EmbedSection(content, sumContent, GOSUM, []string{GOMOD})
+	} else {
+		_, content = RemoveSection(content, GOSUM)
+	}
+	return content, nil
+}
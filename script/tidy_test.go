@@ -0,0 +1,94 @@
+package script
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTidy(t *testing.T) {
+	needsGo(t)
+	t.Setenv("GOPROXY", "off")
+	tests := []struct {
+		name        string
+		imports     string
+		sections    string // besides the go.mod
+		gomod       string // embedded as the module files are, without blank lines
+		wantChanged bool
+		wantMod     string // in the tidied go.mod
+		wantNoSum   bool
+	}{{
+		name:    "already tidy",
+		gomod:   "module hello\ngo 1.24\n",
+		wantMod: "module hello\ngo 1.24\n",
+	}, {
+		name:        "stale go.sum removed",
+		sections:    "// go.sum >>>\n// :example.com/x v1.0.0 h1:abc=\n// <<< go.sum\n",
+		gomod:       "module hello\ngo 1.24\n",
+		wantChanged: true,
+		wantMod:     "module hello\ngo 1.24\n",
+		wantNoSum:   true,
+	}, {
+		name:        "local library required and its path kept",
+		imports:     "\t\"lib\"\n",
+		gomod:       "module hello\ngo 1.24\nreplace lib => LIB\n",
+		wantChanged: true,
+		wantMod:     "replace lib => LIB\nrequire lib v0.0.0-00010101000000-000000000000\n",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			lib := filepath.Join(dir, "lib")
+			if err := os.MkdirAll(lib, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(lib, "go.mod"), []byte("module lib\n\ngo 1.24\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(lib, "lib.go"), []byte("package lib\n\nconst Hi = \"hi\"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			main := "fmt.Println(\"hi\")"
+			if tt.imports != "" {
+				main = "fmt.Println(lib.Hi)"
+			}
+			var gomod strings.Builder
+			for _, line := range strings.Split(strings.TrimSuffix(strings.ReplaceAll(tt.gomod, "LIB", lib), "\n"), "\n") {
+				gomod.WriteString("// :" + line + "\n")
+			}
+			content := "package main\n\nimport (\n\t\"fmt\"\n" + tt.imports + ")\n\nfunc main() {\n\t" + main + "\n}\n\n" +
+				"// go.mod >>>\n" + gomod.String() + "// <<< go.mod\n" + tt.sections
+			path := filepath.Join(dir, "hello.go")
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			s, err := New(path, Options{TmpDirBase: t.TempDir()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			changed, err := s.Tidy()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed != tt.wantChanged {
+				t.Errorf("changed %v, want %v", changed, tt.wantChanged)
+			}
+			tidied, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mod := string(GetSection(tidied, GOMOD)); !strings.Contains(mod, strings.ReplaceAll(tt.wantMod, "LIB", lib)) {
+				t.Errorf("got go.mod:\n%s\nwant it to contain:\n%s", mod, tt.wantMod)
+			}
+			if _, found := findSection(tidied, GOSUM); found && tt.wantNoSum {
+				t.Errorf("got a go.sum section, want it removed")
+			}
+			for _, name := range []string{GOMOD, GOSUM} {
+				if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+					t.Errorf("left %v beside the script", name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package script
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+)
+
+// goVer extracts a goversion from the output of a "go version %v" command
+func goVer(gobin string, args []string, verPos int) (version string, err error) {
+	var stdoutBuf bytes.Buffer
+	cmd := exec.Command(gobin, args...)
+	cmd.Stdout = &stdoutBuf
+	cmd.Env = os.Environ()
+	err = cmd.Run()
+	if err == nil {
+		versionArr := strings.Split(strings.TrimSuffix(stdoutBuf.String(), "\n"), " ")
+		if len(versionArr) >= 2 {
+			version = versionArr[len(versionArr)+verPos]
+		} else {
+			err = errors.New(fmt.Sprintf("unable to find version in %+v", versionArr))
+		}
+	}
+	return
+}
+
+// compiledVersion returns the version of go used to compile a file
+func compiledVersion(gobin string, filepath string) (fileVersion string, err error) {
+	// last entry is the version for a file:
+	// /tmp/gorun-myhost-0/_usr_local_bin_myFile.go/myFile.go.bin: go1.23.2
+	fileVersion, err = goVer(gobin, []string{"version", filepath}, -1)
+	return
+}
+
+// installedGoVersion returns the version of the go toolchain gobin
+func installedGoVersion(gobin string) (gobinVersion string, err error) {
+	// second last entry is the version for a file:
+	// go version go1.23.2 linux/amd64
+	gobinVersion, err = goVer(gobin, []string{"version"}, -2)
+	return
+}
+
+// goBinaryPath returns the path to the go binary
+func goBinaryPath() (gobin string, err error) {
+	// find the go binary to call via env var, std location, or the PATH
+	goRoot := runtime.GOROOT()
+	// Only use GOROOT if we have one, otherwise we end up with a relative path and os.Stat() will
+	// look in the working directory, which isn't the working dictionary later when we run the go bin.
+	if goRoot != "" {
+		gobin = filepath.Join(runtime.GOROOT(), "bin", "go")
+		if _, err := os.Stat(gobin); err == nil {
+			return gobin, nil
+		}
+	}
+
+	// Look in the PATH
+	if gobin, err = exec.LookPath("go"); err == nil {
+		return gobin, nil
+	}
+	return gobin, errors.New(fmt.Sprintf("can't find go tool in GOROOT (%s) or PATH (%s)", goRoot, os.Getenv("PATH")))
+}
+
+// goBinary returns the go binary to build with, the pinned toolchain if one was selected, otherwise the installed one
+func (s *Script) goBinary() (gobin string, err error) {
+	if s.gobin == "" {
+		s.gobin, err = goBinaryPath()
+	}
+	return s.gobin, err
+}
+
+// goModContent returns the go.mod used to build the script, embedded or alongside the script on disc
+func (s *Script) goModContent() (content []byte, err error) {
+	content = s.section(GOMOD)
+	if len(content) == 0 {
+		content, err = os.ReadFile(filepath.Join(filepath.Dir(s.scriptPath), GOMOD))
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	return
+}
+
+// wantedToolchain returns the toolchain the go.mod asks for, e.g. "go1.24.2" from "toolchain go1.24.2", or
+// "go1.24.0" from "go 1.24.0" if there is no toolchain line. Empty if neither is present.
+func wantedToolchain(gomod []byte) (version string, err error) {
+	mf, err := modfile.Parse(GOMOD, gomod, nil)
+	if err != nil {
+		return
+	}
+	if mf.Toolchain != nil && mf.Toolchain.Name != "" {
+		return mf.Toolchain.Name, nil
+	}
+	if mf.Go != nil && mf.Go.Version != "" {
+		return "go" + mf.Go.Version, nil
+	}
+	return "", nil
+}
+
+// findToolchain looks for <toolchainDir>/<version>/bin/go. A version without a patch release (e.g. go1.24) matches
+// the newest patch release installed (e.g. go1.24.3)
+func findToolchain(toolchainDir string, version string) (gobin string, foundVersion string) {
+	gobin = filepath.Join(toolchainDir, version, "bin", "go")
+	if _, err := os.Stat(gobin); err == nil {
+		return gobin, version
+	}
+	if strings.Count(version, ".") != 1 {
+		return "", ""
+	}
+	matches, _ := filepath.Glob(filepath.Join(toolchainDir, version+".*", "bin", "go"))
+	bestPatch := -1
+	for _, match := range matches {
+		dirVersion := filepath.Base(filepath.Dir(filepath.Dir(match)))
+		patch, err := strconv.Atoi(strings.TrimPrefix(dirVersion, version+"."))
+		if err == nil && patch > bestPatch {
+			bestPatch = patch
+			gobin, foundVersion = match, dirVersion
+		}
+	}
+	if bestPatch < 0 {
+		return "", ""
+	}
+	return
+}
+
+// pinToolchain selects the go toolchain from s.toolchainDir matching the go.mod toolchain (or go) directive.
+// If it isn't installed, either fail or fall back to the installed go, depending on s.toolchainPolicy
+func (s *Script) pinToolchain() (err error) {
+	if s.toolchainPolicy != ToolchainFallback && s.toolchainPolicy != ToolchainRequire {
+		return fmt.Errorf("invalid toolchain policy %q, must be fallback or require", s.toolchainPolicy)
+	}
+	gomod, err := s.goModContent()
+	if err != nil {
+		return
+	}
+	wanted, err := wantedToolchain(gomod)
+	if err != nil {
+		return fmt.Errorf("unable to parse go.mod to find the pinned toolchain: %w", err)
+	}
+	if wanted == "" {
+		s.log.Debug("no go or toolchain directive in go.mod, using installed go", "script", s.scriptPath)
+		return nil
+	}
+	gobin, version := findToolchain(s.toolchainDir, wanted)
+	if gobin == "" {
+		if s.toolchainPolicy == ToolchainRequire {
+			return fmt.Errorf("toolchain %v pinned by go.mod not found under %v (expected %v)",
+				wanted, s.toolchainDir, filepath.Join(s.toolchainDir, wanted, "bin", "go"))
+		}
+		s.log.Warn("pinned toolchain not found, falling back to the installed go",
+			"script", s.scriptPath, "toolchain", wanted, "toolchainDir", s.toolchainDir)
+		return nil
+	}
+	s.log.Debug("using pinned toolchain", "script", s.scriptPath, "toolchain", version, "go", gobin)
+	s.gobin = gobin
+	s.pinnedGoVersion = version
+	return nil
+}
+
+// toolchainVersion returns the version of the go toolchain that will build the script, preferring the
+// $GOROOT/VERSION file over running "go env GOVERSION", as this is needed every time a script is run
+func (s *Script) toolchainVersion() (version string, err error) {
+	if s.pinnedGoVersion != "" {
+		return s.pinnedGoVersion, nil
+	}
+	gobin, err := s.goBinary()
+	if err != nil {
+		return
+	}
+	if realGobin, err := filepath.EvalSymlinks(gobin); err == nil {
+		content, err := os.ReadFile(filepath.Join(filepath.Dir(realGobin), "..", "VERSION"))
+		if err == nil {
+			version, _, _ = strings.Cut(string(content), "\n")
+			if strings.HasPrefix(version, "go") {
+				return strings.TrimSpace(version), nil
+			}
+		}
+	}
+	version, err = goVer(gobin, []string{"env", "GOVERSION"}, -1)
+	if err != nil {
+		return "", fmt.Errorf("unable to find the version of %v: %w", gobin, err)
+	}
+	return
+}
+
+// cacheVariant names the toolchain and target platform the script is built for, e.g. go1.24.2-linux-amd64-v1
+func (s *Script) cacheVariant() (variant string, err error) {
+	version, err := s.toolchainVersion()
+	if err != nil {
+		return
+	}
+	env := s.buildEnv()
+	goos := getEnvVar(env, "GOOS")
+	if goos == "" {
+		goos = runtime.GOOS
+	}
+	goarch := getEnvVar(env, "GOARCH")
+	if goarch == "" {
+		goarch = runtime.GOARCH
+	}
+	variant = version + "-" + goos + "-" + goarch
+	// the micro architecture level changes the binary too
+	switch goarch {
+	case "amd64":
+		level := getEnvVar(env, "GOAMD64")
+		if level == "" {
+			level = "v1"
+		}
+		variant += "-" + level
+	case "arm64":
+		level := getEnvVar(env, "GOARM64")
+		if level == "" {
+			level = "v8.0"
+		}
+		variant += "-" + level
+	case "arm":
+		if level := getEnvVar(env, "GOARM"); level != "" {
+			variant += "-v" + level
+		}
+	}
+	// a hermetic build depends only on its own environment, never share a binary with any other
+	if s.hermetic {
+		variant += "-hermetic-" + hermeticEnvKey(env)
+	}
+	// never let the environment escape the script's cache directory
+	return strings.NewReplacer(string(filepath.Separator), "_", "..", "_").Replace(variant), nil
+}
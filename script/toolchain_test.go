@@ -0,0 +1,186 @@
+package script
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// makeToolchains creates an empty <dir>/<version>/bin/go for each version
+func makeToolchains(t *testing.T, versions ...string) (dir string) {
+	t.Helper()
+	dir = t.TempDir()
+	for _, version := range versions {
+		gobin := filepath.Join(dir, version, "bin", "go")
+		if err := os.MkdirAll(filepath.Dir(gobin), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(gobin, nil, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return
+}
+
+func TestWantedToolchain(t *testing.T) {
+	tests := []struct {
+		name  string
+		gomod string
+		want  string
+	}{
+		{"toolchain line", "module hello\n\ngo 1.24.0\n\ntoolchain go1.24.2\n", "go1.24.2"},
+		{"go line", "module hello\n\ngo 1.24.0\n", "go1.24.0"},
+		{"go line without a patch release", "module hello\n\ngo 1.24\n", "go1.24"},
+		{"neither", "module hello\n", ""},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := wantedToolchain([]byte(tt.gomod))
+			if err != nil || got != tt.want {
+				t.Errorf("got %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+	if _, err := wantedToolchain([]byte("go one\n")); err == nil {
+		t.Errorf("got no error for an unparsable go.mod")
+	}
+}
+
+func TestFindToolchain(t *testing.T) {
+	dir := makeToolchains(t, "go1.23.1", "go1.24.2", "go1.24.10", "go1.24.3rc1", "go1.25")
+	tests := []struct {
+		version string
+		want    string // empty if not found
+	}{
+		{"go1.24.2", "go1.24.2"},
+		{"go1.24", "go1.24.10"}, // the newest patch release, by number not name
+		{"go1.23", "go1.23.1"},
+		{"go1.25", "go1.25"}, // an exact match wins
+		{"go1.24.5", ""},     // a patch release must match exactly
+		{"go1.22", ""},
+		{"go1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			gobin, version := findToolchain(dir, tt.version)
+			if version != tt.want {
+				t.Errorf("got %q, want %q", version, tt.want)
+			}
+			if want := filepath.Join(dir, tt.want, "bin", "go"); tt.want != "" && gobin != want {
+				t.Errorf("got %v, want %v", gobin, want)
+			} else if tt.want == "" && gobin != "" {
+				t.Errorf("got %v, want nothing", gobin)
+			}
+		})
+	}
+}
+
+func TestPinToolchain(t *testing.T) {
+	dir := makeToolchains(t, "go1.24.2")
+	tests := []struct {
+		name    string
+		policy  string
+		gomod   string
+		want    string // the pinned version, empty for the installed go
+		wantErr string
+	}{
+		{"installed", ToolchainRequire, "module hello\n\ngo 1.24.0\n\ntoolchain go1.24.2\n", "go1.24.2", ""},
+		{"patch release picked", ToolchainRequire, "module hello\n\ngo 1.24\n", "go1.24.2", ""},
+		{"missing, fall back", ToolchainFallback, "module hello\n\ngo 1.24.0\n\ntoolchain go1.24.9\n", "", ""},
+		{"missing, required", ToolchainRequire, "module hello\n\ngo 1.24.0\n\ntoolchain go1.24.9\n", "", "toolchain go1.24.9 pinned by go.mod not found"},
+		{"nothing pinned", ToolchainRequire, "module hello\n", "", ""},
+		{"invalid policy", "maybe", "module hello\n\ngo 1.24\n", "", "invalid toolchain policy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Script{
+				scriptPath:      filepath.Join(t.TempDir(), "hello.go"),
+				sections:        []Section{{Name: GOMOD, Content: []byte(tt.gomod)}},
+				toolchainDir:    dir,
+				toolchainPolicy: tt.policy,
+				log:             slog.New(slog.DiscardHandler),
+			}
+			err := s.pinToolchain()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.pinnedGoVersion != tt.want {
+				t.Errorf("got %q, want %q", s.pinnedGoVersion, tt.want)
+			}
+			if tt.want != "" && s.gobin != filepath.Join(dir, tt.want, "bin", "go") {
+				t.Errorf("got go %v, want the one under %v", s.gobin, dir)
+			} else if tt.want == "" && s.gobin != "" {
+				t.Errorf("got go %v, want the installed one", s.gobin)
+			}
+		})
+	}
+}
+
+func TestCacheVariant(t *testing.T) {
+	// the caller's environment is overridden by go.env in each case
+	for _, key := range []string{"GOOS", "GOARCH", "GOAMD64", "GOARM64", "GOARM"} {
+		t.Setenv(key, "")
+	}
+	tests := []struct {
+		name  string
+		goenv string
+		want  string
+	}{
+		{"amd64 default level", "GOOS=linux\nGOARCH=amd64", "go1.24.2-linux-amd64-v1"},
+		{"amd64 level", "GOOS=linux\nGOARCH=amd64\nGOAMD64=v3", "go1.24.2-linux-amd64-v3"},
+		{"arm64 default level", "GOOS=darwin\nGOARCH=arm64", "go1.24.2-darwin-arm64-v8.0"},
+		{"arm64 level", "GOOS=linux\nGOARCH=arm64\nGOARM64=v9.0", "go1.24.2-linux-arm64-v9.0"},
+		{"arm without a level", "GOOS=linux\nGOARCH=arm", "go1.24.2-linux-arm"},
+		{"arm level", "GOOS=linux\nGOARCH=arm\nGOARM=7", "go1.24.2-linux-arm-v7"},
+		{"other architecture", "GOOS=linux\nGOARCH=riscv64", "go1.24.2-linux-riscv64"},
+		{"the last setting wins", "GOOS=windows\nGOOS=linux\nGOARCH=386", "go1.24.2-linux-386"},
+		{"kept in the cache directory", "GOOS=..\nGOARCH=amd64", "go1.24.2-_-amd64-v1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Script{pinnedGoVersion: "go1.24.2", sections: []Section{{Name: GOENV, Content: []byte(tt.goenv)}}}
+			got, err := s.cacheVariant()
+			if err != nil || got != tt.want {
+				t.Errorf("got %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+
+	t.Run("platform defaults", func(t *testing.T) {
+		got, err := (&Script{pinnedGoVersion: "go1.24.2"}).cacheVariant()
+		if want := "go1.24.2-" + runtime.GOOS + "-" + runtime.GOARCH; err != nil || !strings.HasPrefix(got, want) {
+			t.Errorf("got %q, %v, want %q...", got, err, want)
+		}
+	})
+
+	t.Run("hermetic", func(t *testing.T) {
+		variant := func(goenv string) string {
+			s := &Script{pinnedGoVersion: "go1.24.2", hermetic: true, sections: []Section{{Name: GOENV, Content: []byte(goenv)}}}
+			got, err := s.cacheVariant()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return got
+		}
+		a, b := variant("GOOS=linux\nGOARCH=amd64\nCGO_ENABLED=0"), variant("GOOS=linux\nGOARCH=amd64\nCGO_ENABLED=1")
+		if !strings.HasPrefix(a, "go1.24.2-linux-amd64-v1-hermetic-") {
+			t.Errorf("got %q, want a hermetic variant", a)
+		}
+		if a == b {
+			t.Errorf("got %q for both, want the go.env to change the variant", a)
+		}
+		if again := variant("GOOS=linux\nGOARCH=amd64\nCGO_ENABLED=0"); again != a {
+			t.Errorf("got %q then %q, want the same variant", a, again)
+		}
+	})
+}
@@ -0,0 +1,93 @@
+package script
+
+import (
+	"fmt"
+	"sort"
+
+	"golang.org/x/mod/modfile"
+)
+
+// ModuleChange is a change to the version of a module required by the embedded go.mod. Old is empty if the module
+// was added, New is empty if it was removed
+type ModuleChange struct {
+	Path string
+	Old  string
+	New  string
+}
+
+func (c ModuleChange) String() string {
+	switch {
+	case c.Old == "":
+		return fmt.Sprintf("%v added %v", c.Path, c.New)
+	case c.New == "":
+		return fmt.Sprintf("%v removed %v", c.Path, c.Old)
+	}
+	return fmt.Sprintf("%v %v => %v", c.Path, c.Old, c.New)
+}
+
+// Get runs 'go get' for each module (e.g. 'github.com/a/b@v1.2.3') then 'go mod tidy' on the script laid out in its
+// build tree, embedding the resulting go.mod and go.sum back in to the script. It returns the changed
+// module versions
+func (s *Script) Get(modules ...string) (changes []ModuleChange, err error) {
+	if len(modules) == 0 {
+		return nil, fmt.Errorf("no modules given to get")
+	}
+	return s.changeModules([]string{"get"}, modules)
+}
+
+// Upgrade runs 'go get -u' (or 'go get -u=patch' if patch is set) for all the script's dependencies then
+// 'go mod tidy', embedding the resulting go.mod and go.sum back in to the script. It returns the changed module versions
+func (s *Script) Upgrade(patch bool) (changes []ModuleChange, err error) {
+	upgrade := "-u"
+	if patch {
+		upgrade = "-u=patch"
+	}
+	return s.changeModules([]string{"get", upgrade}, []string{"./..."})
+}
+
+// changeModules runs go get with the given args then tidies, returning the changed module versions
+func (s *Script) changeModules(get []string, args []string) (changes []ModuleChange, err error) {
+	get = append(get, args...)
+	oldMod, newMod, _, err := s.updateModules(get, []string{"mod", "tidy"})
+	if err != nil {
+		return
+	}
+	return moduleChanges(oldMod, newMod)
+}
+
+// moduleChanges compares the required module versions of two go.mod files, sorted by module path
+func moduleChanges(oldMod []byte, newMod []byte) (changes []ModuleChange, err error) {
+	oldVersions, err := requiredVersions(oldMod)
+	if err != nil {
+		return
+	}
+	newVersions, err := requiredVersions(newMod)
+	if err != nil {
+		return
+	}
+	for path, version := range newVersions {
+		if oldVersions[path] != version {
+			changes = append(changes, ModuleChange{Path: path, Old: oldVersions[path], New: version})
+		}
+	}
+	for path, version := range oldVersions {
+		if _, ok := newVersions[path]; !ok {
+			changes = append(changes, ModuleChange{Path: path, Old: version})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return
+}
+
+// requiredVersions returns the version of each module required by a go.mod, keyed by module path
+func requiredVersions(gomod []byte) (versions map[string]string, err error) {
+	versions = map[string]string{}
+	mf, err := modfile.Parse(GOMOD, gomod, nil)
+	if err != nil {
+		return
+	}
+	for _, r := range mf.Require {
+		versions[r.Mod.Path] = r.Mod.Version
+	}
+	return
+}
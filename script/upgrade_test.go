@@ -0,0 +1,60 @@
+package script
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestModuleChanges(t *testing.T) {
+	base := "module hello\ngo 1.24\nrequire (\n\texample.com/a v1.0.0\n\texample.com/b v1.1.0 // indirect\n)\n"
+	tests := []struct {
+		name   string
+		newMod string
+		want   []ModuleChange
+	}{
+		{"unchanged", base, nil},
+		{"reformatted", "module hello\ngo 1.24\nrequire example.com/b v1.1.0 // indirect\nrequire example.com/a v1.0.0\n", nil},
+		{"upgraded", "module hello\ngo 1.24\nrequire (\n\texample.com/a v1.2.0\n\texample.com/b v1.1.1 // indirect\n)\n", []ModuleChange{
+			{Path: "example.com/a", Old: "v1.0.0", New: "v1.2.0"},
+			{Path: "example.com/b", Old: "v1.1.0", New: "v1.1.1"},
+		}},
+		{"added and removed", "module hello\ngo 1.24\nrequire (\n\texample.com/0 v0.1.0\n\texample.com/a v1.0.0\n)\n", []ModuleChange{
+			{Path: "example.com/0", New: "v0.1.0"},
+			{Path: "example.com/b", Old: "v1.1.0"},
+		}},
+		{"all removed", "module hello\ngo 1.24\n", []ModuleChange{
+			{Path: "example.com/a", Old: "v1.0.0"},
+			{Path: "example.com/b", Old: "v1.1.0"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := moduleChanges([]byte(base), []byte(tt.newMod))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if _, err := moduleChanges([]byte(base), []byte("require (\n")); err == nil {
+		t.Errorf("got no error for an unparsable go.mod")
+	}
+}
+
+func TestModuleChangeString(t *testing.T) {
+	tests := []struct {
+		change ModuleChange
+		want   string
+	}{
+		{ModuleChange{Path: "example.com/a", Old: "v1.0.0", New: "v1.2.0"}, "example.com/a v1.0.0 => v1.2.0"},
+		{ModuleChange{Path: "example.com/a", New: "v1.2.0"}, "example.com/a added v1.2.0"},
+		{ModuleChange{Path: "example.com/a", Old: "v1.0.0"}, "example.com/a removed v1.0.0"},
+	}
+	for _, tt := range tests {
+		if got := tt.change.String(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package script
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Symlink policies, for symlinks found in the extra source directory and go.work libraries
+const (
+	SymlinksRecreate = "recreate" // copy symlinks as symlinks, pointing where the original does
+	SymlinksFollow   = "follow"   // copy what symlinks point to, as if they were regular files and directories
+)
+
+// walker walks the source directories that are copied in to the build tree and checked for changes, so copying,
+// change detection and hashing all see the same files
+type walker struct {
+	symlinks  string   // SymlinksRecreate or SymlinksFollow
+	scriptDir string   // errors name paths relative to this
+	copied    []string // directories copied in to the build tree, that recreated relative symlinks may point in to
+}
+
+// walkFunc is called for each file and directory found. info is for the symlink itself under SymlinksRecreate, and
+// for what it points to under SymlinksFollow. Returning filepath.SkipDir or filepath.SkipAll works as for filepath.Walk
+type walkFunc func(path string, info os.FileInfo) error
+
+// rel names a path relative to the script's directory, for error messages
+func (w walker) rel(path string) string {
+	if rel, err := filepath.Rel(w.scriptDir, path); err == nil {
+		return rel
+	}
+	return path
+}
+
+// walk calls fn for root and everything under it, in lexical order, leaving out anything excluded by a .gorunignore
+// file in root. Any file that isn't a regular file, directory or (allowed) symlink is an error, as is a symlink cycle
+// under SymlinksFollow
+func (w walker) walk(root string, fn walkFunc) (err error) {
+	info, err := os.Lstat(root)
+	if err != nil {
+		return fmt.Errorf("unable to find %v: %w", w.rel(root), err)
+	}
+	rules, err := loadIgnoreRules(root)
+	if err != nil {
+		return fmt.Errorf("unable to read ignore rules: %w", err)
+	}
+	r := &walkRoot{root: root, rules: rules, ancestors: map[string]bool{}}
+	err = w.walkPath(r, root, info, fn)
+	if errors.Is(err, filepath.SkipDir) || errors.Is(err, filepath.SkipAll) {
+		return nil
+	}
+	return
+}
+
+// walkRoot is the state of a walk from one root directory
+type walkRoot struct {
+	root      string
+	rules     ignoreRules     // from the root's .gorunignore
+	ancestors map[string]bool // real paths of the directories being walked above the current path
+}
+
+// ignored reports whether the root's .gorunignore excludes path
+func (r *walkRoot) ignored(path string, info os.FileInfo) bool {
+	rel, err := filepath.Rel(r.root, path)
+	return err == nil && rel != "." && r.rules.ignored(filepath.ToSlash(rel), info.IsDir())
+}
+
+// walkPath walks path, unless it is ignored
+func (w walker) walkPath(r *walkRoot, path string, info os.FileInfo, fn walkFunc) (err error) {
+	if r.ignored(path, info) {
+		return nil
+	}
+	if info.Mode()&os.ModeSymlink != 0 && w.symlinks == SymlinksFollow {
+		info, err = os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("broken symlink %v: %w", w.rel(path), err)
+		}
+		if r.ignored(path, info) { // e.g. a 'dir/' pattern matching a symlink to a directory
+			return nil
+		}
+	} else if info.Mode()&os.ModeSymlink != 0 {
+		if err = w.checkRecreatable(path); err != nil {
+			return err
+		}
+	}
+
+	switch info.Mode() & os.ModeType {
+	case 0, os.ModeSymlink: // Regular file, or a symlink to be recreated
+		return fn(path, info)
+	case os.ModeDir:
+	default:
+		return fmt.Errorf("only regular files, directories and symlinks are supported, not %v (%v)", w.rel(path), info.Mode().Type())
+	}
+
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return fmt.Errorf("unable to resolve %v: %w", w.rel(path), err)
+	}
+	if r.ancestors[real] {
+		return fmt.Errorf("symlink cycle at %v, it leads back to %v", w.rel(path), real)
+	}
+	if err = fn(path, info); err != nil {
+		if errors.Is(err, filepath.SkipDir) {
+			return nil
+		}
+		return err
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return fmt.Errorf("unable to read %v: %w", w.rel(path), err)
+	}
+	r.ancestors[real] = true
+	defer delete(r.ancestors, real)
+	for _, entry := range entries {
+		child := filepath.Join(path, entry.Name())
+		childInfo, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("unable to find %v: %w", w.rel(child), err)
+		}
+		err = w.walkPath(r, child, childInfo, fn)
+		if errors.Is(err, filepath.SkipDir) {
+			return nil // skip the rest of this directory
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRecreatable makes sure a relative symlink will still point at something once recreated in the build tree,
+// i.e. within one of the directories copied there
+func (w walker) checkRecreatable(path string) (err error) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return fmt.Errorf("unable to read symlink %v: %w", w.rel(path), err)
+	}
+	if filepath.IsAbs(target) {
+		return nil // still points at the original
+	}
+	resolved := filepath.Join(filepath.Dir(path), target)
+	for _, dir := range w.copied {
+		if resolved == dir || strings.HasPrefix(resolved, dir+string(filepath.Separator)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("symlink %v points to %v, outside the directories copied in to the build, use -symlinks=follow",
+		w.rel(path), w.rel(resolved))
+}
+
+// walker returns the walker for the script's source directories
+func (s *Script) walker() walker {
+	return walker{symlinks: s.symlinks, scriptDir: filepath.Dir(s.scriptPath), copied: s.sourceDirs()}
+}
@@ -0,0 +1,190 @@
+package script
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// makeTree creates the files (ending in '/' for a directory) and symlinks (name to target) under root
+func makeTree(t *testing.T, root string, files []string, symlinks map[string]string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on windows")
+	}
+	for _, name := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range symlinks {
+		if err := os.Symlink(strings.ReplaceAll(target, "ROOT", root), filepath.Join(root, filepath.FromSlash(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWalkSymlinks(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		files    []string
+		symlinks map[string]string
+		want     []string // paths walked, relative to the extra directory, with a trailing '@' for a symlink
+		wantErr  string
+	}{{
+		name:     "recreate a relative symlink within the directory",
+		policy:   SymlinksRecreate,
+		files:    []string{"x_/a.go", "x_/sub/"},
+		symlinks: map[string]string{"x_/sub/b.go": "../a.go"},
+		want:     []string{".", "a.go", "sub", "sub/b.go@"},
+	}, {
+		name:     "recreate an absolute symlink",
+		policy:   SymlinksRecreate,
+		files:    []string{"x_/", "outside/c.go"},
+		symlinks: map[string]string{"x_/c.go": "ROOT/outside/c.go"},
+		want:     []string{".", "c.go@"},
+	}, {
+		name:     "a relative symlink outside the copied directories",
+		policy:   SymlinksRecreate,
+		files:    []string{"x_/", "outside/c.go"},
+		symlinks: map[string]string{"x_/c.go": "../outside/c.go"},
+		wantErr:  "outside the directories copied in to the build, use -symlinks=follow",
+	}, {
+		name:     "follow a relative symlink outside",
+		policy:   SymlinksFollow,
+		files:    []string{"x_/", "outside/lib/c.go"},
+		symlinks: map[string]string{"x_/lib": "../outside/lib"},
+		want:     []string{".", "lib", "lib/c.go"},
+	}, {
+		name:     "follow a broken symlink",
+		policy:   SymlinksFollow,
+		files:    []string{"x_/"},
+		symlinks: map[string]string{"x_/gone.go": "nowhere.go"},
+		wantErr:  "broken symlink x_/gone.go",
+	}, {
+		name:     "follow a cycle",
+		policy:   SymlinksFollow,
+		files:    []string{"x_/sub/"},
+		symlinks: map[string]string{"x_/sub/loop": ".."},
+		wantErr:  "symlink cycle at x_/sub/loop",
+	}, {
+		name:     "recreate a cycle, which isn't walked in to",
+		policy:   SymlinksRecreate,
+		files:    []string{"x_/sub/"},
+		symlinks: map[string]string{"x_/sub/loop": ".."},
+		want:     []string{".", "sub", "sub/loop@"},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			makeTree(t, root, tt.files, tt.symlinks)
+			dir := filepath.Join(root, "x_")
+			w := walker{symlinks: tt.policy, scriptDir: root, copied: []string{dir}}
+			var got []string
+			err := w.walk(dir, func(path string, info os.FileInfo) error {
+				rel, _ := filepath.Rel(dir, path)
+				if info.Mode()&os.ModeSymlink != 0 {
+					rel += "@"
+				}
+				got = append(got, filepath.ToSlash(rel))
+				return nil
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWalkSpecialFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix sockets")
+	}
+	dir := t.TempDir()
+	l, err := net.Listen("unix", filepath.Join(dir, "sock"))
+	if err != nil {
+		t.Skip("no unix sockets:", err)
+	}
+	defer l.Close()
+	err = walker{symlinks: SymlinksRecreate, scriptDir: dir}.walk(dir, func(string, os.FileInfo) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "not sock") {
+		t.Errorf("got %v, want the socket refused", err)
+	}
+}
+
+func TestAbsoluteSymlinkTargetIsAnInput(t *testing.T) {
+	needsGo(t)
+	root := t.TempDir()
+	makeTree(t, root, []string{"hello_/", "outside/data/data.txt", "outside/conf.txt"}, map[string]string{
+		"hello_/data": "ROOT/outside/data",
+		"hello_/conf": "ROOT/outside/conf.txt",
+	})
+	path := filepath.Join(root, "hello.go")
+	start := time.Now().Add(-time.Hour)
+	writeScript(t, path, `fmt.Println("hi")`, start)
+	s, err := New(path, Options{TmpDirBase: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Command(); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := s.inputHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, changed := range []string{"outside/data/data.txt", "outside/conf.txt"} {
+		t.Run(changed, func(t *testing.T) {
+			if reasons, err := s.Explain(); err != nil || len(reasons) != 0 {
+				t.Fatalf("before the change: got %q, %v, want up to date", reasons, err)
+			}
+			file := filepath.Join(root, filepath.FromSlash(changed))
+			if err := os.WriteFile(file, []byte("changed"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			later := time.Now().Add(time.Minute)
+			if err := os.Chtimes(file, later, later); err != nil {
+				t.Fatal(err)
+			}
+			reasons, err := s.Explain()
+			if err != nil || len(reasons) == 0 {
+				t.Errorf("after the change: got %q, %v, want out of date", reasons, err)
+			}
+			changedHash, err := s.inputHash()
+			if err != nil || changedHash == hash {
+				t.Errorf("after the change: input hash %v, %v, want it changed", changedHash, err)
+			}
+			hash = changedHash
+			// back to before the binary, for the next change
+			if err := os.Chtimes(file, start, start); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
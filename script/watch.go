@@ -0,0 +1,192 @@
+package script
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const (
+	watchPollInterval = 500 * time.Millisecond // how often inputs are checked where there is no inotify
+	watchSettle       = 100 * time.Millisecond // wait for an editor to finish saving before looking
+	watchStopTimeout  = 5 * time.Second        // how long a stopped script gets to exit before it is killed
+)
+
+// changeWatcher blocks until something in the watched directories may have changed
+type changeWatcher interface {
+	wait(ctx context.Context) error
+	close()
+}
+
+// pollWatcher is the fallback changeWatcher, the caller compares the inputs after every interval
+type pollWatcher struct{}
+
+func (pollWatcher) wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(watchPollInterval):
+		return nil
+	}
+}
+
+func (pollWatcher) close() {}
+
+// Watch compiles and runs the script with args, its stdin, stdout and stderr being this process's, then recompiles
+// and restarts it whenever one of its inputs (those checked by OutOfDate) changes, until ctx is done. If a compile
+// fails the error is logged and written to the build output as usual, and any previous run is left running until a
+// later change compiles. A script that exits by itself is restarted on the next change
+func (s *Script) Watch(ctx context.Context, args ...string) (err error) {
+	var running *exec.Cmd
+	var exited chan error
+	defer func() { s.stopWatched(running, exited) }()
+
+	for {
+		// reread the script every time, e.g. a go.work library may have been added
+		s.initialised = false
+		err = s.initVars()
+		state, dirs, inputsErr := s.watchState()
+		if err == nil {
+			err = inputsErr
+		}
+		if err == nil {
+			var cmd *exec.Cmd
+			cmd, err = s.Command(args...)
+			if err == nil {
+				s.stopWatched(running, exited)
+				running, exited, err = s.startWatched(cmd)
+			}
+		}
+		if err != nil {
+			var buildErr *BuildError
+			if errors.As(err, &buildErr) {
+				s.log.Warn("compile failed, waiting for a change", "script", s.scriptPath)
+			} else {
+				s.log.Error("unable to run script, waiting for a change", "script", s.scriptPath, "err", err)
+			}
+		}
+
+		s.log.Info("watching for changes", "script", s.scriptPath, "dirs", len(dirs))
+		err = s.waitForChange(ctx, state, dirs, &exited)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return
+		}
+		s.log.Info("change detected, recompiling", "script", s.scriptPath)
+	}
+}
+
+// startWatched starts cmd attached to this process's stdin, stdout and stderr. exited receives its result
+func (s *Script) startWatched(cmd *exec.Cmd) (running *exec.Cmd, exited chan error, err error) {
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Start(); err != nil {
+		return nil, nil, fmt.Errorf("failed to start %v: %w", s.binary, err)
+	}
+	s.log.Info("started script", "script", s.scriptPath, "scriptPid", cmd.Process.Pid)
+	exited = make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	return cmd, exited, nil
+}
+
+// stopWatched asks a running script to stop (SIGTERM), killing it if it hasn't exited after watchStopTimeout
+func (s *Script) stopWatched(running *exec.Cmd, exited chan error) {
+	if exited == nil {
+		return
+	}
+	s.log.Info("stopping script", "script", s.scriptPath, "scriptPid", running.Process.Pid)
+	if err := running.Process.Signal(syscall.SIGTERM); err != nil {
+		_ = running.Process.Kill() // e.g. no signals on windows
+	}
+	select {
+	case <-exited:
+	case <-time.After(watchStopTimeout):
+		s.log.Warn("script didn't stop, killing it", "script", s.scriptPath, "scriptPid", running.Process.Pid)
+		_ = running.Process.Kill()
+		<-exited
+	}
+}
+
+// waitForChange returns once the inputs differ from state, or ctx is done. If the script exits meanwhile its exit
+// status is logged and *exited set to nil, so it isn't stopped again
+func (s *Script) waitForChange(ctx context.Context, state [sha256.Size]byte, dirs []string, exited *chan error) (err error) {
+	watcher, err := newChangeWatcher(dirs)
+	if err != nil {
+		s.log.Warn("unable to watch for changes, polling instead", "err", err)
+		watcher = pollWatcher{}
+	}
+	defer watcher.close()
+
+	waitCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	changed := make(chan error, 1)
+	go func() {
+		for {
+			if err := watcher.wait(waitCtx); err != nil {
+				changed <- err
+				return
+			}
+			select {
+			case <-waitCtx.Done():
+				changed <- waitCtx.Err()
+				return
+			case <-time.After(watchSettle):
+			}
+			// an input that can't be read (e.g. mid save) changes the state too, and is retried on the next change
+			if newState, _, _ := s.watchState(); newState != state {
+				changed <- nil
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case err = <-changed:
+			return
+		case exitErr := <-*exited:
+			*exited = nil // a nil channel blocks, so it is only reported once
+			if exitErr != nil {
+				s.log.Warn("script exited, waiting for a change", "script", s.scriptPath, "err", exitErr)
+			} else {
+				s.log.Info("script exited, waiting for a change", "script", s.scriptPath)
+			}
+		}
+	}
+}
+
+// watchState summarises the script's inputs (path, size, mode and modification time of each) so a change to any of
+// them can be spotted, and lists the directories to watch for changes: those holding the script and its bundle, and
+// every directory of the source directories
+func (s *Script) watchState() (state [sha256.Size]byte, dirs []string, err error) {
+	h := sha256.New()
+	seen := map[string]bool{}
+	addDir := func(dir string) {
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	addDir(filepath.Dir(s.scriptPath))
+	if s.bundlePath != "" {
+		addDir(filepath.Dir(s.bundlePath))
+	}
+	err = s.walkInputs(func(path string, info os.FileInfo) error {
+		_, _ = fmt.Fprintf(h, "%v\x00%d\x00%v\x00%d\n", path, info.Size(), info.Mode(), info.ModTime().UnixNano())
+		if info.IsDir() {
+			addDir(path)
+		}
+		return nil
+	})
+	copy(state[:], h.Sum(nil))
+	return
+}
@@ -0,0 +1,58 @@
+//go:build linux
+
+package script
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// inotifyEvents are the changes to a watched directory (or the files in it) that wake an inotifyWatcher
+const inotifyEvents = syscall.IN_MODIFY | syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE | syscall.IN_CREATE |
+	syscall.IN_DELETE | syscall.IN_DELETE_SELF | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_MOVE_SELF
+
+// inotifyWatcher wakes on any change in the watched directories, letting the caller decide whether an input changed
+type inotifyWatcher struct {
+	f *os.File
+}
+
+// newChangeWatcher watches each of dirs (not their subdirectories, which are listed separately) with inotify
+func newChangeWatcher(dirs []string) (watcher changeWatcher, err error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("inotify_init: %w", err)
+	}
+	// non-blocking, so reads go through the runtime's poller and are interrupted by close
+	w := &inotifyWatcher{f: os.NewFile(uintptr(fd), "inotify")}
+	for _, dir := range dirs {
+		if _, err = syscall.InotifyAddWatch(fd, dir, inotifyEvents); err != nil {
+			w.close()
+			return nil, fmt.Errorf("inotify_add_watch %v: %w", dir, err)
+		}
+	}
+	return w, nil
+}
+
+func (w *inotifyWatcher) wait(ctx context.Context) (err error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = w.f.Close() // wakes the read below
+		case <-done:
+		}
+	}()
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	_, err = w.f.Read(buf) // the events themselves don't matter, only that there were some
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (w *inotifyWatcher) close() {
+	_ = w.f.Close()
+}
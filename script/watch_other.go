@@ -0,0 +1,8 @@
+//go:build !linux
+
+package script
+
+// newChangeWatcher polls, as there is no inotify
+func newChangeWatcher(dirs []string) (watcher changeWatcher, err error) {
+	return pollWatcher{}, nil
+}
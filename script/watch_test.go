@@ -0,0 +1,129 @@
+package script
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWatchState(t *testing.T) {
+	needsGo(t)
+	tests := []struct {
+		name        string
+		change      func(t *testing.T, dir string)
+		wantChanged bool
+	}{
+		{"nothing", func(t *testing.T, dir string) {}, false},
+		{"script edited", func(t *testing.T, dir string) {
+			writeScript(t, filepath.Join(dir, "hello.go"), `fmt.Println("edited")`, time.Now())
+		}, true},
+		{"source file touched", func(t *testing.T, dir string) {
+			now := time.Now()
+			if err := os.Chtimes(filepath.Join(dir, "hello_", "sub", "x.go"), now, now); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"source file added", func(t *testing.T, dir string) {
+			if err := os.WriteFile(filepath.Join(dir, "hello_", "y.go"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"source file removed", func(t *testing.T, dir string) {
+			if err := os.Remove(filepath.Join(dir, "hello_", "sub", "x.go")); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"unrelated file beside the script", func(t *testing.T, dir string) {
+			if err := os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			old := time.Now().Add(-time.Hour)
+			writeScript(t, filepath.Join(dir, "hello.go"), `fmt.Println("hi")`, old)
+			if err := os.MkdirAll(filepath.Join(dir, "hello_", "sub"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "hello_", "sub", "x.go"), []byte("package sub\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			s, err := New(filepath.Join(dir, "hello.go"), Options{TmpDirBase: t.TempDir()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = s.initVars(); err != nil {
+				t.Fatal(err)
+			}
+			state, dirs, err := s.watchState()
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantDirs := []string{dir, filepath.Join(dir, "hello_"), filepath.Join(dir, "hello_", "sub")}
+			if !reflect.DeepEqual(dirs, wantDirs) {
+				t.Errorf("watching %q, want %q", dirs, wantDirs)
+			}
+
+			tt.change(t, dir)
+			newState, _, err := s.watchState()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed := newState != state; changed != tt.wantChanged {
+				t.Errorf("changed %v, want %v", changed, tt.wantChanged)
+			}
+		})
+	}
+}
+
+func TestWatchRestartsOnChange(t *testing.T) {
+	needsGo(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hello.go")
+	out := filepath.Join(dir, "out")
+	// each version writes its name, then runs until it is stopped
+	write := func(version string) {
+		content := "package main\n\nimport (\n\t\"os\"\n\t\"time\"\n)\n\nfunc main() {\n\t_ = os.WriteFile(os.Args[1], []byte(" +
+			version + "), 0644)\n\ttime.Sleep(time.Hour)\n}\n\n// go.mod >>>\n// :module hello\n// :\n// :go 1.24\n// <<< go.mod\n"
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor := func(want string) {
+		t.Helper()
+		for deadline := time.Now().Add(30 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+			if got, _ := os.ReadFile(out); string(got) == want {
+				return
+			}
+		}
+		got, _ := os.ReadFile(out)
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	write(`"v1"`)
+	s, err := New(path, Options{TmpDirBase: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Watch(ctx, out) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("watch: %v", err)
+		}
+	}()
+	waitFor("v1")
+
+	// a compile failure is logged, and watched through to the next change
+	write(`undefined`)
+	time.Sleep(2 * watchPollInterval)
+	write(`"v2"`)
+	waitFor("v2")
+}